@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
-	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,6 +18,11 @@ import (
 
 const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 30 * time.Second
+)
+
 func FromConfigMap(
 	ctx context.Context,
 	cmName, fileName string,
@@ -55,21 +60,21 @@ func FromConfigMap(
 		return nil, err
 	}
 
-	routes, err := configMapToRoutes(cm, fileName)
+	p, err := configMapToPolicy(cm, fileName)
 	if err != nil {
 		return nil, err
 	}
 
 	authz := &MemoryAuthorizer{
-		cfg:    cfg,
-		routes: routes,
+		cfg: cfg,
 	}
+	authz.apply(p)
 	authz.watcher = watchConfigMap(authz, clientSet, namespace, cmName, fileName)
 
 	return authz, nil
 }
 
-func configMapToRoutes(cm *corev1.ConfigMap, fileName string) (map[spiffeid.ID][]Route, error) {
+func configMapToPolicy(cm *corev1.ConfigMap, fileName string) (*policy, error) {
 	src, ok := cm.Data[fileName]
 	if !ok {
 		return nil, fmt.Errorf("could not find file %s in configmap %s", fileName, cm.GetName())
@@ -81,12 +86,15 @@ func configMapToRoutes(cm *corev1.ConfigMap, fileName string) (map[spiffeid.ID][
 		return nil, err
 	}
 
-	return cfg.toRouteMap()
+	return cfg.toPolicy()
 }
 
-// TODO: Simplify/restructure this.
-//
-//nolint:gocognit
+// watchConfigMap returns a watcher that applies changes to the configmap
+// until ctx is done. The API server ends watches after a while, so they're
+// started again, waiting longer each time a watch ends quickly. It returns an
+// error if the configmap is deleted, if the proxy isn't allowed to watch it,
+// or if the API server reports an error, since the rules can no longer be
+// updated.
 func watchConfigMap(
 	ma *MemoryAuthorizer,
 	clientSet *kubernetes.Clientset,
@@ -100,73 +108,97 @@ func watchConfigMap(
 			Name:      cmName,
 		}
 
-		watcher, err := clientSet.CoreV1().
-			ConfigMaps(namespace).
-			Watch(ctx, metav1.SingleObject(objMeta))
-		if err != nil {
-			if apierrors.IsUnauthorized(err) {
-				logger.WarnContext(
-					ctx,
-					"could not start configmap watcher; need 'watch' permission",
-				)
+		backoff := minWatchBackoff
+		for ctx.Err() == nil {
+			started := time.Now()
+			watcher, err := clientSet.CoreV1().
+				ConfigMaps(namespace).
+				Watch(ctx, metav1.SingleObject(objMeta))
+			if err != nil {
+				if apierrors.IsUnauthorized(err) || apierrors.IsForbidden(err) {
+					return fmt.Errorf("could not start configmap watcher; need 'watch' permission: %w", err)
+				}
 
-				return nil
+				return err
 			}
 
-			return err
-		}
+			err = applyConfigMapEvents(ctx, logger, ma, watcher.ResultChan(), fileName)
+			watcher.Stop()
+			if err != nil {
+				return err
+			}
 
-		resultChan := watcher.ResultChan()
+			// A watch that ran for a while ended normally, so start over.
+			if time.Since(started) > maxWatchBackoff {
+				backoff = minWatchBackoff
+			}
 
-	resultLoop:
-		for {
 			select {
 			case <-ctx.Done():
-				watcher.Stop()
-
-				break resultLoop
-			case event := <-resultChan:
-				switch event.Type {
-				case watch.Added:
-					fallthrough
-				case watch.Modified:
-					updatedMap, ok := event.Object.(*corev1.ConfigMap)
-					if !ok {
-						logger.WarnContext(ctx, "error from k8s api, not a configmap")
-
-						continue
-					}
-
-					routes, err := configMapToRoutes(updatedMap, fileName)
-					if err != nil {
-						logger.WarnContext(ctx, "error reading new configmap data", "error", err)
-
-						continue
-					}
-
-					ma.Update(routes)
-					logger.InfoContext(ctx, "updated authz rules from configmap")
-				case watch.Error:
-					apiErr, ok := event.Object.(*metav1.Status)
-					if ok {
-						logger.ErrorContext(ctx, "error from k8s api, stopping watcher", "error", apiErr)
-					} else {
-						logger.ErrorContext(ctx, "unknown error from k8s api, stopping watcher")
-					}
-
-					watcher.Stop()
-
-					break resultLoop
-				case watch.Deleted:
-					logger.WarnContext(ctx, "configmap has been deleted, stopping watcher")
-					watcher.Stop()
-
-					break resultLoop
-				case watch.Bookmark:
-				}
+			case <-time.After(backoff):
 			}
+
+			backoff = min(backoff*2, maxWatchBackoff) //nolint:mnd
 		}
 
 		return nil
 	}
 }
+
+// applyConfigMapEvents applies the changes from events until ctx is done or
+// events is closed.
+func applyConfigMapEvents(
+	ctx context.Context,
+	logger *slog.Logger,
+	ma *MemoryAuthorizer,
+	events <-chan watch.Event,
+	fileName string,
+) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				logger.DebugContext(ctx, "configmap watch ended, restarting")
+
+				return nil
+			}
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				updatedMap, ok := event.Object.(*corev1.ConfigMap)
+				if !ok {
+					logger.WarnContext(ctx, "error from k8s api, not a configmap")
+
+					continue
+				}
+
+				p, err := configMapToPolicy(updatedMap, fileName)
+				if err != nil {
+					logger.WarnContext(ctx, "error reading new configmap data", "error", err)
+
+					continue
+				}
+
+				ma.apply(p)
+				logger.InfoContext(ctx, "updated authz rules from configmap")
+			case watch.Error:
+				if apiErr, ok := event.Object.(*metav1.Status); ok {
+					logger.ErrorContext(ctx, "error from k8s api, stopping watcher", "error", apiErr)
+
+					return fmt.Errorf("error from k8s api: %s", apiErr.Message)
+				}
+
+				logger.ErrorContext(ctx, "unknown error from k8s api, stopping watcher")
+
+				return errors.New("unknown error from k8s api")
+			case watch.Deleted:
+				logger.WarnContext(ctx, "configmap has been deleted, stopping watcher")
+
+				return errors.New("configmap has been deleted")
+			case watch.Bookmark:
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package authorizer
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// ErrDenied is returned when a caller's SPIFFE ID or certificate is on the
+// deny-list.
+var ErrDenied = errors.New("denied")
+
+// DenyList blocks SVIDs before they expire, for instance after a key leaks.
+// Entries can match the SPIFFE ID, the certificate serial number, or the
+// SHA-256 fingerprint of the certificate's SubjectPublicKeyInfo.
+type DenyList struct {
+	ids     map[spiffeid.ID]struct{}
+	serials map[string]struct{}
+	spkis   map[[sha256.Size]byte]struct{}
+}
+
+// NewDenyList builds a DenyList. Serials are hexadecimal, optionally
+// separated with colons. SPKI fingerprints are SHA-256 hashes, either as
+// hexadecimal or as standard base64.
+func NewDenyList(ids, serials, spkis []string) (*DenyList, error) {
+	d := &DenyList{
+		ids:     make(map[spiffeid.ID]struct{}, len(ids)),
+		serials: make(map[string]struct{}, len(serials)),
+		spkis:   make(map[[sha256.Size]byte]struct{}, len(spkis)),
+	}
+
+	for _, s := range ids {
+		id, err := spiffeid.FromString(s)
+		if err != nil {
+			return nil, err
+		}
+		d.ids[id] = struct{}{}
+	}
+
+	for _, s := range serials {
+		serial, ok := new(big.Int).SetString(strings.ReplaceAll(s, ":", ""), 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %q", s)
+		}
+		d.serials[serial.Text(16)] = struct{}{}
+	}
+
+	for _, s := range spkis {
+		fp, err := parseFingerprint(s)
+		if err != nil {
+			return nil, err
+		}
+		d.spkis[fp] = struct{}{}
+	}
+
+	return d, nil
+}
+
+// Check returns an error wrapping ErrDenied if id or cert is on the list.
+// cert may be nil, for instance when the caller used a JWT-SVID.
+func (d *DenyList) Check(id spiffeid.ID, cert *x509.Certificate) error {
+	if d == nil {
+		return nil
+	}
+
+	if _, ok := d.ids[id]; ok {
+		return fmt.Errorf("%w: spiffeid %s", ErrDenied, id)
+	}
+
+	if cert == nil {
+		return nil
+	}
+
+	if cert.SerialNumber != nil {
+		serial := cert.SerialNumber.Text(16)
+		if _, ok := d.serials[serial]; ok {
+			return fmt.Errorf("%w: serial %s", ErrDenied, serial)
+		}
+	}
+
+	if _, ok := d.spkis[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+		return fmt.Errorf("%w: public key of %s", ErrDenied, id)
+	}
+
+	return nil
+}
+
+// Len is the total number of entries on the list.
+func (d *DenyList) Len() int {
+	if d == nil {
+		return 0
+	}
+
+	return len(d.ids) + len(d.serials) + len(d.spkis)
+}
+
+func parseFingerprint(s string) ([sha256.Size]byte, error) {
+	var fp [sha256.Size]byte
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(b) != sha256.Size {
+		return fp, fmt.Errorf("invalid SPKI SHA-256 fingerprint %q", s)
+	}
+
+	copy(fp[:], b)
+
+	return fp, nil
+}
@@ -0,0 +1,131 @@
+package authorizer_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/authorizer"
+)
+
+func TestDenyList_Check(t *testing.T) {
+	spid := spiffeid.RequireFromString("spiffe://example.org/leaked")
+	other := spiffeid.RequireFromString("spiffe://example.org/fine")
+	cert := newTestCert(t, 0xabcdef)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	t.Run("spiffeid", func(t *testing.T) {
+		d, err := authorizer.NewDenyList([]string{spid.String()}, nil, nil)
+		require.NoError(t, err)
+
+		require.ErrorIs(t, d.Check(spid, nil), authorizer.ErrDenied)
+		require.NoError(t, d.Check(other, nil))
+	})
+
+	t.Run("serial", func(t *testing.T) {
+		d, err := authorizer.NewDenyList(nil, []string{"00:AB:CD:EF"}, nil)
+		require.NoError(t, err)
+
+		require.ErrorIs(t, d.Check(other, cert), authorizer.ErrDenied)
+		require.NoError(t, d.Check(other, newTestCert(t, 0x1234)))
+		require.NoError(t, d.Check(other, nil))
+	})
+
+	t.Run("spki hex", func(t *testing.T) {
+		d, err := authorizer.NewDenyList(nil, nil, []string{hex.EncodeToString(spki[:])})
+		require.NoError(t, err)
+
+		require.ErrorIs(t, d.Check(other, cert), authorizer.ErrDenied)
+		require.NoError(t, d.Check(other, newTestCert(t, 0xabcdef)))
+	})
+
+	t.Run("spki base64", func(t *testing.T) {
+		d, err := authorizer.NewDenyList(nil, nil, []string{base64.StdEncoding.EncodeToString(spki[:])})
+		require.NoError(t, err)
+
+		require.ErrorIs(t, d.Check(other, cert), authorizer.ErrDenied)
+	})
+
+	t.Run("invalid entries", func(t *testing.T) {
+		_, err := authorizer.NewDenyList([]string{"not an id"}, nil, nil)
+		require.Error(t, err)
+
+		_, err = authorizer.NewDenyList(nil, []string{"xyz"}, nil)
+		require.Error(t, err)
+
+		_, err = authorizer.NewDenyList(nil, nil, []string{"abcd"})
+		require.Error(t, err)
+	})
+
+	t.Run("nil list", func(t *testing.T) {
+		var d *authorizer.DenyList
+
+		require.NoError(t, d.Check(spid, cert))
+	})
+}
+
+func TestFromFile_Deny(t *testing.T) {
+	authz, err := authorizer.FromFile("testconfigs/deny.hcl")
+	require.NoError(t, err)
+
+	denied := spiffeid.RequireFromString("spiffe://example.org/a/leaked")
+	allowed := spiffeid.RequireFromString("spiffe://example.org/a/workload")
+
+	require.ErrorIs(t, authz.CheckDenied(denied, nil), authorizer.ErrDenied)
+	require.NoError(t, authz.CheckDenied(allowed, nil))
+
+	require.ErrorIs(t, authz.CheckDenied(allowed, newTestCert(t, 0x1f)), authorizer.ErrDenied)
+	require.NoError(t, authz.CheckDenied(allowed, newTestCert(t, 0x20)))
+}
+
+func newTestCert(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
+
+func TestMemory_DenyListUpdated(t *testing.T) {
+	authz := &authorizer.MemoryAuthorizer{}
+	updated := authz.DenyListUpdated()
+
+	select {
+	case <-updated:
+		t.Fatal("closed before the deny-list changed")
+	default:
+	}
+
+	d, err := authorizer.NewDenyList([]string{"spiffe://example.org/a/leaked"}, nil, nil)
+	require.NoError(t, err)
+	authz.UpdateDenyList(d)
+
+	select {
+	case <-updated:
+	default:
+		t.Fatal("not closed after the deny-list changed")
+	}
+}
@@ -2,8 +2,10 @@ package authorizer
 
 import (
 	"fmt"
+	"net/http"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
@@ -15,14 +17,114 @@ import (
 type hclPath struct {
 	Pattern string   `hcl:"name,label"`
 	Methods []string `hcl:"methods"`
+	Auth    string   `hcl:"auth,optional"`
+
+	ReadTimeout  string `hcl:"read_timeout,optional"`
+	WriteTimeout string `hcl:"write_timeout,optional"`
+	MaxBodyBytes int64  `hcl:"max_body_bytes,optional"`
+}
+
+func (p *hclPath) route() (Route, error) {
+	if p.MaxBodyBytes < 0 {
+		return Route{}, fmt.Errorf("invalid max_body_bytes %d for path %s", p.MaxBodyBytes, p.Pattern)
+	}
+
+	route := Route{
+		Pattern:      p.Pattern,
+		Methods:      p.Methods,
+		Auth:         p.Auth,
+		MaxBodyBytes: p.MaxBodyBytes,
+	}
+
+	if err := setTimeouts(&route, p.ReadTimeout, p.WriteTimeout); err != nil {
+		return Route{}, fmt.Errorf("%w for path %s", err, p.Pattern)
+	}
+
+	return route, nil
+}
+
+// setTimeouts parses the read_timeout and write_timeout attributes of a
+// block, which use time.ParseDuration syntax, into r.
+func setTimeouts(r *Route, readTimeout, writeTimeout string) error {
+	var err error
+	if readTimeout != "" {
+		if r.ReadTimeout, err = time.ParseDuration(readTimeout); err != nil {
+			return fmt.Errorf("invalid read_timeout: %w", err)
+		}
+	}
+
+	if writeTimeout != "" {
+		if r.WriteTimeout, err = time.ParseDuration(writeTimeout); err != nil {
+			return fmt.Errorf("invalid write_timeout: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// hclGRPC allows methods of a gRPC service, named with its package, like
+// "payments.v1.Ledger". Each method becomes a POST route to
+// /payments.v1.Ledger/Method, and "*" allows all of them.
+type hclGRPC struct {
+	Service string   `hcl:"name,label"`
+	Methods []string `hcl:"methods"`
+	Auth    string   `hcl:"auth,optional"`
+
+	ReadTimeout  string `hcl:"read_timeout,optional"`
+	WriteTimeout string `hcl:"write_timeout,optional"`
+	MaxBodyBytes int64  `hcl:"max_body_bytes,optional"`
+}
+
+func (g *hclGRPC) routes() ([]Route, error) {
+	if g.Service == "" || strings.Contains(g.Service, "/") {
+		return nil, fmt.Errorf("invalid gRPC service name %q", g.Service)
+	}
+
+	if g.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("invalid max_body_bytes %d for gRPC service %s", g.MaxBodyBytes, g.Service)
+	}
+
+	routes := make([]Route, 0, len(g.Methods))
+	for _, method := range g.Methods {
+		if method == "" || strings.Contains(method, "/") {
+			return nil, fmt.Errorf("invalid gRPC method name %q for service %s", method, g.Service)
+		}
+
+		route := Route{
+			Pattern:      "/" + g.Service + "/" + method,
+			Methods:      []string{http.MethodPost},
+			Auth:         g.Auth,
+			MaxBodyBytes: g.MaxBodyBytes,
+		}
+		if err := setTimeouts(&route, g.ReadTimeout, g.WriteTimeout); err != nil {
+			return nil, fmt.Errorf("%w for gRPC service %s", err, g.Service)
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
 }
 
 type hclEntry struct {
 	SPIFFEID string    `hcl:"name,label"`
 	Paths    []hclPath `hcl:"path,block"`
+	GRPC     []hclGRPC `hcl:"grpc,block"`
+}
+
+type hclPublic struct {
+	Paths []hclPath `hcl:"path,block"`
+	GRPC  []hclGRPC `hcl:"grpc,block"`
+}
+
+type hclDeny struct {
+	SPIFFEIDs  []string `hcl:"spiffeids,optional"`
+	Serials    []string `hcl:"serials,optional"`
+	SPKISHA256 []string `hcl:"spki_sha256,optional"`
 }
 
 type hclConfig struct {
+	Public  *hclPublic `hcl:"public,block"`
+	Deny    []hclDeny  `hcl:"deny,block"`
 	Entries []hclEntry `hcl:"spiffeid,block"`
 }
 
@@ -64,23 +166,130 @@ func (h *hclConfig) toRouteMap() (map[spiffeid.ID][]Route, error) {
 		routes[id] = make([]Route, 0, len(entry.Paths))
 
 		for _, path := range entry.Paths {
-			routes[id] = append(routes[id], Route(path))
+			route, err := path.route()
+			if err != nil {
+				return nil, fmt.Errorf("%w on %s", err, id)
+			}
+			routes[id] = append(routes[id], route)
+		}
+
+		grpcRoutes, err := toGRPCRoutes(entry.GRPC)
+		if err != nil {
+			return nil, fmt.Errorf("%w on %s", err, id)
+		}
+		routes[id] = append(routes[id], grpcRoutes...)
+
+		for _, route := range routes[id] {
+			if err := checkAuth(route); err != nil {
+				return nil, fmt.Errorf("%w on %s", err, id)
+			}
 		}
 	}
 
 	return routes, nil
 }
 
-func (h *hclConfig) toAuthorizer(cfg *config) (*MemoryAuthorizer, error) {
+func (h *hclConfig) toPublicRoutes() ([]Route, error) {
+	if h.Public == nil {
+		return nil, nil
+	}
+
+	routes := make([]Route, 0, len(h.Public.Paths))
+	for _, path := range h.Public.Paths {
+		route, err := path.route()
+		if err != nil {
+			return nil, fmt.Errorf("%w in public", err)
+		}
+		routes = append(routes, route)
+	}
+
+	grpcRoutes, err := toGRPCRoutes(h.Public.GRPC)
+	if err != nil {
+		return nil, fmt.Errorf("%w in public", err)
+	}
+	routes = append(routes, grpcRoutes...)
+
+	for _, route := range routes {
+		// Public routes allow callers without any credentials, so there's
+		// no auth method to restrict.
+		if route.Auth != "" {
+			return nil, fmt.Errorf("auth is not allowed for public path %s", route.Pattern)
+		}
+	}
+
+	return routes, nil
+}
+
+// checkAuth returns an error if the route's auth isn't a known value.
+func checkAuth(route Route) error {
+	switch route.Auth {
+	case "", AuthAny, AuthX509, AuthJWT:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unsupported auth %q for path %s, must be one of [%s, %s, %s]",
+			route.Auth, route.Pattern, AuthAny, AuthX509, AuthJWT,
+		)
+	}
+}
+
+func toGRPCRoutes(services []hclGRPC) ([]Route, error) {
+	var routes []Route
+	for _, svc := range services {
+		svcRoutes, err := svc.routes()
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, svcRoutes...)
+	}
+
+	return routes, nil
+}
+
+func (h *hclConfig) toDenyList() (*DenyList, error) {
+	var ids, serials, spkis []string
+	for _, d := range h.Deny {
+		ids = append(ids, d.SPIFFEIDs...)
+		serials = append(serials, d.Serials...)
+		spkis = append(spkis, d.SPKISHA256...)
+	}
+
+	return NewDenyList(ids, serials, spkis)
+}
+
+func (h *hclConfig) toPolicy() (*policy, error) {
 	routes, err := h.toRouteMap()
 	if err != nil {
 		return nil, err
 	}
 
-	a := &MemoryAuthorizer{
-		cfg:    cfg,
+	public, err := h.toPublicRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	denied, err := h.toDenyList()
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy{
 		routes: routes,
+		public: public,
+		denied: denied,
+	}, nil
+}
+
+func (h *hclConfig) toAuthorizer(cfg *config) (*MemoryAuthorizer, error) {
+	p, err := h.toPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &MemoryAuthorizer{
+		cfg: cfg,
 	}
+	a.apply(p)
 
 	return a, nil
 }
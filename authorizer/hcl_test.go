@@ -3,12 +3,17 @@ package authorizer_test
 import (
 	"context"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"jsocol.io/spiffe-authz-proxy/authorizer"
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
 )
 
 func TestFromFile_HCL(t *testing.T) {
@@ -42,3 +47,266 @@ func TestFromFile_Conf(t *testing.T) {
 	err = authz.Authorize(context.Background(), spidB, http.MethodDelete, "/foo/bar")
 	require.NoError(t, err)
 }
+
+func TestFromFile_Public(t *testing.T) {
+	fileName := "testconfigs/public.hcl"
+	spidA := spiffeid.RequireFromString("spiffe://example.org/a/workload")
+
+	authz, err := authorizer.FromFile(fileName)
+	require.NoError(t, err)
+	require.NotNil(t, authz)
+
+	err = authz.Authorize(context.Background(), spiffeid.ID{}, http.MethodGet, "/healthz")
+	require.NoError(t, err)
+
+	err = authz.Authorize(context.Background(), spiffeid.ID{}, http.MethodGet, "/foo/bar")
+	require.ErrorIs(t, err, authorizer.ErrUnauthenticated)
+
+	err = authz.Authorize(context.Background(), spidA, http.MethodGet, "/foo/bar")
+	require.NoError(t, err)
+
+	err = authz.Authorize(context.Background(), spiffeid.ID{}, http.MethodGet, "/status/deep")
+	require.NoError(t, err)
+
+	// A public path doesn't make shorter paths public too.
+	err = authz.Authorize(context.Background(), spiffeid.ID{}, http.MethodGet, "/status")
+	require.ErrorIs(t, err, authorizer.ErrUnauthenticated)
+}
+
+func TestFromFile_PublicAuth(t *testing.T) {
+	tests := map[string]string{
+		"path": `public {
+  path "/healthz" {
+    methods = ["GET"]
+    auth    = "x509"
+  }
+}`,
+		"gRPC": `public {
+  grpc "grpc.health.v1.Health" {
+    methods = ["Check"]
+    auth    = "any"
+  }
+}`,
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "public.hcl")
+			require.NoError(t, os.WriteFile(fileName, []byte(src), 0o600))
+
+			_, err := authorizer.FromFile(fileName)
+			require.ErrorContains(t, err, "auth is not allowed")
+		})
+	}
+}
+
+func TestFromFile_GRPC(t *testing.T) {
+	fileName := "testconfigs/grpc.hcl"
+	spidA := spiffeid.RequireFromString("spiffe://example.org/a/workload")
+
+	authz, err := authorizer.FromFile(fileName)
+	require.NoError(t, err)
+	require.NotNil(t, authz)
+
+	tests := map[string]struct {
+		spid    spiffeid.ID
+		method  string
+		path    string
+		allowed bool
+	}{
+		"listed method": {
+			spid:    spidA,
+			method:  http.MethodPost,
+			path:    "/payments.v1.Ledger/GetBalance",
+			allowed: true,
+		},
+		"unlisted method": {
+			spid:   spidA,
+			method: http.MethodPost,
+			path:   "/payments.v1.Ledger/Transfer",
+		},
+		"not POST": {
+			spid:   spidA,
+			method: http.MethodGet,
+			path:   "/payments.v1.Ledger/GetBalance",
+		},
+		"any method": {
+			spid:    spidA,
+			method:  http.MethodPost,
+			path:    "/payments.v1.Admin/Freeze",
+			allowed: true,
+		},
+		"public": {
+			method:  http.MethodPost,
+			path:    "/grpc.health.v1.Health/Check",
+			allowed: true,
+		},
+	}
+
+	ctx := spiffeidutil.WithAuthMethod(context.Background(), spiffeidutil.AuthMethodX509)
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := authz.Authorize(ctx, tc.spid, tc.method, tc.path)
+			if tc.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestFromFile_GRPCInvalid(t *testing.T) {
+	tests := map[string]string{
+		"service with a slash": `spiffeid "spiffe://example.org/a" {
+  grpc "payments.v1/Ledger" {
+    methods = ["GetBalance"]
+  }
+}`,
+		"empty method": `spiffeid "spiffe://example.org/a" {
+  grpc "payments.v1.Ledger" {
+    methods = [""]
+  }
+}`,
+		"bad auth": `spiffeid "spiffe://example.org/a" {
+  grpc "payments.v1.Ledger" {
+    methods = ["GetBalance"]
+    auth    = "password"
+  }
+}`,
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "grpc.hcl")
+			require.NoError(t, os.WriteFile(fileName, []byte(src), 0o600))
+
+			_, err := authorizer.FromFile(fileName)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestFromFile_RouteTimeouts(t *testing.T) {
+	fileName := "testconfigs/timeouts.hcl"
+	spidA := spiffeid.RequireFromString("spiffe://example.org/a/workload")
+
+	authz, err := authorizer.FromFile(fileName)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		spid         spiffeid.ID
+		method       string
+		path         string
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+	}{
+		"read timeout": {
+			spid:        spidA,
+			method:      http.MethodPut,
+			path:        "/upload/big.tar",
+			readTimeout: 5 * time.Minute,
+		},
+		"no overrides": {
+			spid:   spidA,
+			method: http.MethodGet,
+			path:   "/api/items",
+		},
+		"gRPC": {
+			spid:         spidA,
+			method:       http.MethodPost,
+			path:         "/backups.v1.Backups/Restore",
+			writeTimeout: time.Hour,
+		},
+		"public": {
+			method:       http.MethodGet,
+			path:         "/downloads/big.tar",
+			writeTimeout: 10 * time.Minute,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			route, err := authz.AuthorizeRoute(context.Background(), tc.spid, tc.method, tc.path)
+			require.NoError(t, err)
+			assert.Equal(t, tc.readTimeout, route.ReadTimeout)
+			assert.Equal(t, tc.writeTimeout, route.WriteTimeout)
+		})
+	}
+}
+
+func TestFromFile_RouteTimeoutsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"path": `spiffeid "spiffe://example.org/a" {
+  path "/upload/**" {
+    methods      = ["PUT"]
+    read_timeout = "five minutes"
+  }
+}`,
+		"gRPC": `spiffeid "spiffe://example.org/a" {
+  grpc "backups.v1.Backups" {
+    methods       = ["Restore"]
+    write_timeout = "1 hour"
+  }
+}`,
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "timeouts.hcl")
+			require.NoError(t, os.WriteFile(fileName, []byte(src), 0o600))
+
+			_, err := authorizer.FromFile(fileName)
+			require.ErrorContains(t, err, "_timeout")
+		})
+	}
+}
+
+func TestFromFile_MaxBodyBytes(t *testing.T) {
+	fileName := "testconfigs/limits.hcl"
+	spidA := spiffeid.RequireFromString("spiffe://example.org/a/workload")
+
+	authz, err := authorizer.FromFile(fileName)
+	require.NoError(t, err)
+
+	route, err := authz.AuthorizeRoute(context.Background(), spidA, http.MethodPut, "/upload/big.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "/upload/**", route.Pattern)
+	assert.Equal(t, int64(100<<20), route.MaxBodyBytes)
+
+	route, err = authz.AuthorizeRoute(context.Background(), spidA, http.MethodPost, "/api/items")
+	require.NoError(t, err)
+	assert.Zero(t, route.MaxBodyBytes)
+
+	route, err = authz.AuthorizeRoute(context.Background(), spidA, http.MethodPost, "/backups.v1.Backups/Upload")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), route.MaxBodyBytes)
+}
+
+func TestFromFile_MaxBodyBytesInvalid(t *testing.T) {
+	tests := map[string]string{
+		"path": `spiffeid "spiffe://example.org/a" {
+  path "/upload/**" {
+    methods        = ["PUT"]
+    max_body_bytes = -1
+  }
+}`,
+		"gRPC": `spiffeid "spiffe://example.org/a" {
+  grpc "backups.v1.Backups" {
+    methods        = ["Upload"]
+    max_body_bytes = -1
+  }
+}`,
+	}
+
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "limits.hcl")
+			require.NoError(t, os.WriteFile(fileName, []byte(src), 0o600))
+
+			_, err := authorizer.FromFile(fileName)
+			require.ErrorContains(t, err, "max_body_bytes")
+		})
+	}
+}
@@ -2,12 +2,16 @@ package authorizer
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"slices"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
 )
 
 const (
@@ -16,64 +20,138 @@ const (
 	WildcardSegment  = "*"
 )
 
+// Values for Route.Auth, which limit how a caller must have authenticated.
+const (
+	AuthAny  = "any"
+	AuthX509 = "x509"
+	AuthJWT  = "jwt"
+)
+
+// ErrUnauthenticated is returned by Authorize when the caller did not present
+// an SPIFFE ID and the route is not public.
+var ErrUnauthenticated = errors.New("an SVID is required")
+
 type Route struct {
 	Pattern string
 	Methods []string
+	// Auth is one of AuthAny, AuthX509, or AuthJWT. Empty is the same as
+	// AuthAny.
+	Auth string
+	// ReadTimeout and WriteTimeout, if set, replace the server's timeouts
+	// for requests that match, like long uploads or downloads.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MaxBodyBytes, if set, replaces the proxy's limit on the size of
+	// request bodies for requests that match.
+	MaxBodyBytes int64
 }
 
-func (r *Route) Match(method, path string) bool {
-	if !slices.Contains(r.Methods, method) && !slices.Contains(r.Methods, "*") {
-		return false
+// AllowsAuth reports whether a caller that authenticated with m may use the
+// route.
+func (r *Route) AllowsAuth(m spiffeidutil.AuthMethod) bool {
+	switch r.Auth {
+	case "", AuthAny:
+		return true
+	default:
+		return r.Auth == string(m)
 	}
+}
 
-	rPath := strings.TrimRight(r.Pattern, "/")
-	parts := strings.Split(rPath, "/")
-	lastPart := len(parts) - 1
+func (r *Route) Match(method, path string) bool {
+	return r.matchMethod(method) && MatchPath(r.Pattern, path)
+}
 
-	if parts[0] == WildcardSegments {
-		return true
-	}
+// MatchFull is like Match, but uses MatchFullPath. Public routes are matched
+// this way, so that they don't also allow shorter paths without an SVID.
+func (r *Route) MatchFull(method, path string) bool {
+	return r.matchMethod(method) && MatchFullPath(r.Pattern, path)
+}
 
-	for i, scope := range strings.Split(path, "/") {
-		if i > lastPart {
-			return parts[lastPart] == WildcardSegments
-		}
-		if parts[i] != WildcardSegment && parts[i] != WildcardSegments && parts[i] != scope {
-			return false
-		}
-	}
+func (r *Route) matchMethod(method string) bool {
+	return slices.Contains(r.Methods, method) || slices.Contains(r.Methods, WildcardMethod)
+}
 
-	return true
+// policy is the full set of rules decoded from a single config source.
+type policy struct {
+	routes map[spiffeid.ID][]Route
+	public []Route
+	denied *DenyList
 }
 
 type MemoryAuthorizer struct {
 	// TODO: This is terribly inefficient and probably needs improvement
-	routes  map[spiffeid.ID][]Route
+	routes map[spiffeid.ID][]Route
+	// public routes are allowed for any caller, including callers that did
+	// not present an SVID at all.
+	public  []Route
+	denied  *DenyList
 	mu      sync.RWMutex
 	watcher func(context.Context) error
 	cfg     *config
+	// loaded is set once any rules have been applied, and watchErr once the
+	// watcher stops before its context is done.
+	loaded   bool
+	watchErr error
+	// denyUpdated is closed when the deny-list is replaced.
+	denyUpdated chan struct{}
 }
 
 func (a *MemoryAuthorizer) Authorize(
-	_ context.Context,
+	ctx context.Context,
 	spid spiffeid.ID,
 	method, path string,
 ) error {
+	_, err := a.AuthorizeRoute(ctx, spid, method, path)
+
+	return err
+}
+
+// AuthorizeRoute is like Authorize, but also returns the route that allowed
+// the request. If both one of the caller's routes and a public route match,
+// the caller's route is returned.
+func (a *MemoryAuthorizer) AuthorizeRoute(
+	ctx context.Context,
+	spid spiffeid.ID,
+	method, path string,
+) (Route, error) {
 	a.mu.RLock()
+	public := a.public
 	routes, ok := a.routes[spid]
 	a.mu.RUnlock()
 
-	if !ok {
-		return fmt.Errorf("unknown spiffeid %s", spid)
+	// The caller's own routes come first, so their limits apply even where
+	// a public route also matches.
+	authMethod := spiffeidutil.AuthMethodFromContext(ctx)
+	for _, r := range routes {
+		if r.Match(method, path) && r.AllowsAuth(authMethod) {
+			return r, nil
+		}
 	}
 
-	for _, r := range routes {
-		if r.Match(method, path) {
-			return nil
+	for _, r := range public {
+		if r.MatchFull(method, path) {
+			return r, nil
 		}
 	}
 
-	return fmt.Errorf("spiffeid %s is not authorized for method %s on path %s", spid, method, path)
+	if spid.IsZero() {
+		return Route{}, ErrUnauthenticated
+	}
+
+	if !ok {
+		return Route{}, fmt.Errorf("unknown spiffeid %s", spid)
+	}
+
+	return Route{}, fmt.Errorf("spiffeid %s is not authorized for method %s on path %s", spid, method, path)
+}
+
+// HasSPIFFEID reports whether the policy has any rules for spid.
+func (a *MemoryAuthorizer) HasSPIFFEID(spid spiffeid.ID) bool {
+	a.mu.RLock()
+	_, ok := a.routes[spid]
+	a.mu.RUnlock()
+
+	return ok
 }
 
 func (a *MemoryAuthorizer) Length() int {
@@ -83,13 +161,104 @@ func (a *MemoryAuthorizer) Length() int {
 func (a *MemoryAuthorizer) Update(config map[spiffeid.ID][]Route) {
 	a.mu.Lock()
 	a.routes = config
+	a.loaded = true
+	a.mu.Unlock()
+}
+
+// UpdatePublic replaces the set of routes that do not require an SVID.
+func (a *MemoryAuthorizer) UpdatePublic(routes []Route) {
+	a.mu.Lock()
+	a.public = routes
+	a.loaded = true
 	a.mu.Unlock()
 }
 
+// DenyListLength is the number of entries on the deny-list.
+func (a *MemoryAuthorizer) DenyListLength() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.denied.Len()
+}
+
+// UpdateDenyList replaces the deny-list.
+func (a *MemoryAuthorizer) UpdateDenyList(d *DenyList) {
+	a.mu.Lock()
+	a.denied = d
+	a.notifyDenyList()
+	a.mu.Unlock()
+}
+
+// DenyListUpdated returns a channel that is closed the next time the
+// deny-list is replaced, so that long-lived connections can be checked
+// again.
+func (a *MemoryAuthorizer) DenyListUpdated() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.denyUpdated == nil {
+		a.denyUpdated = make(chan struct{})
+	}
+
+	return a.denyUpdated
+}
+
+// notifyDenyList wakes everyone waiting on DenyListUpdated. a.mu must be
+// held.
+func (a *MemoryAuthorizer) notifyDenyList() {
+	if a.denyUpdated != nil {
+		close(a.denyUpdated)
+		a.denyUpdated = nil
+	}
+}
+
+// CheckDenied returns an error wrapping ErrDenied if the SPIFFE ID or the
+// certificate is on the deny-list. cert may be nil.
+func (a *MemoryAuthorizer) CheckDenied(spid spiffeid.ID, cert *x509.Certificate) error {
+	a.mu.RLock()
+	denied := a.denied
+	a.mu.RUnlock()
+
+	return denied.Check(spid, cert)
+}
+
+func (a *MemoryAuthorizer) apply(p *policy) {
+	a.mu.Lock()
+	a.routes = p.routes
+	a.public = p.public
+	a.denied = p.denied
+	a.loaded = true
+	a.notifyDenyList()
+	a.mu.Unlock()
+}
+
+// Watch keeps the policy up to date with its source until ctx is done. It
+// returns immediately if the source isn't watched. If it stops early, Check
+// reports the error.
 func (a *MemoryAuthorizer) Watch(ctx context.Context) error {
 	if a.watcher == nil {
 		return nil
 	}
 
-	return a.watcher(ctx)
+	err := a.watcher(ctx)
+	if err != nil && ctx.Err() == nil {
+		a.mu.Lock()
+		a.watchErr = fmt.Errorf("policy watcher stopped: %w", err)
+		a.mu.Unlock()
+	}
+
+	return err
+}
+
+// Check returns an error if no policy has been loaded, or if the policy's
+// watcher has stopped, so changes to the policy are no longer applied.
+func (a *MemoryAuthorizer) Check(context.Context) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if !a.loaded {
+		return errors.New("no policy loaded")
+	}
+
+	return a.watchErr
 }
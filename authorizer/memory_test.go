@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"jsocol.io/spiffe-authz-proxy/authorizer"
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
 )
 
 func TestMemory_Authorize(t *testing.T) {
@@ -42,3 +43,109 @@ func TestMemory_Authorize_Unauthorized(t *testing.T) {
 	err := a.Authorize(context.Background(), spid, http.MethodGet, "/foo/bar")
 	require.Error(t, err)
 }
+
+func TestMemory_Authorize_Public(t *testing.T) {
+	spid := spiffeid.RequireFromString("spiffe://example.org/foo")
+	a := &authorizer.MemoryAuthorizer{}
+	a.Update(map[spiffeid.ID][]authorizer.Route{
+		spid: {
+			{
+				Pattern: "/foo/bar",
+				Methods: []string{http.MethodGet},
+			},
+		},
+	})
+	a.UpdatePublic([]authorizer.Route{
+		{
+			Pattern: "/healthz",
+			Methods: []string{http.MethodGet},
+		},
+	})
+
+	err := a.Authorize(context.Background(), spiffeid.ID{}, http.MethodGet, "/healthz")
+	require.NoError(t, err)
+
+	err = a.Authorize(context.Background(), spid, http.MethodGet, "/healthz")
+	require.NoError(t, err)
+
+	err = a.Authorize(context.Background(), spiffeid.ID{}, http.MethodPost, "/healthz")
+	require.ErrorIs(t, err, authorizer.ErrUnauthenticated)
+
+	err = a.Authorize(context.Background(), spiffeid.ID{}, http.MethodGet, "/foo/bar")
+	require.ErrorIs(t, err, authorizer.ErrUnauthenticated)
+}
+
+func TestMemory_AuthorizeRoute_PrefersCaller(t *testing.T) {
+	spid := spiffeid.RequireFromString("spiffe://example.org/foo")
+	a := &authorizer.MemoryAuthorizer{}
+	a.Update(map[spiffeid.ID][]authorizer.Route{
+		spid: {
+			{
+				Pattern:      "/uploads/*",
+				Methods:      []string{http.MethodPost},
+				MaxBodyBytes: 1 << 20,
+			},
+		},
+	})
+	a.UpdatePublic([]authorizer.Route{
+		{
+			Pattern: "/uploads/*",
+			Methods: []string{http.MethodPost},
+		},
+	})
+
+	route, err := a.AuthorizeRoute(context.Background(), spid, http.MethodPost, "/uploads/a")
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<20), route.MaxBodyBytes)
+
+	route, err = a.AuthorizeRoute(context.Background(), spiffeid.ID{}, http.MethodPost, "/uploads/a")
+	require.NoError(t, err)
+	require.Zero(t, route.MaxBodyBytes)
+}
+
+func TestMemory_Authorize_AuthMethod(t *testing.T) {
+	spid := spiffeid.RequireFromString("spiffe://example.org/foo")
+	a := &authorizer.MemoryAuthorizer{}
+	a.Update(map[spiffeid.ID][]authorizer.Route{
+		spid: {
+			{
+				Pattern: "/x509",
+				Methods: []string{http.MethodGet},
+				Auth:    authorizer.AuthX509,
+			},
+			{
+				Pattern: "/jwt",
+				Methods: []string{http.MethodGet},
+				Auth:    authorizer.AuthJWT,
+			},
+			{
+				Pattern: "/either",
+				Methods: []string{http.MethodGet},
+			},
+		},
+	})
+
+	x509Ctx := spiffeidutil.WithAuthMethod(context.Background(), spiffeidutil.AuthMethodX509)
+	jwtCtx := spiffeidutil.WithAuthMethod(context.Background(), spiffeidutil.AuthMethodJWT)
+
+	require.NoError(t, a.Authorize(x509Ctx, spid, http.MethodGet, "/x509"))
+	require.Error(t, a.Authorize(jwtCtx, spid, http.MethodGet, "/x509"))
+
+	require.NoError(t, a.Authorize(jwtCtx, spid, http.MethodGet, "/jwt"))
+	require.Error(t, a.Authorize(x509Ctx, spid, http.MethodGet, "/jwt"))
+
+	require.NoError(t, a.Authorize(x509Ctx, spid, http.MethodGet, "/either"))
+	require.NoError(t, a.Authorize(jwtCtx, spid, http.MethodGet, "/either"))
+}
+
+func TestMemory_Check(t *testing.T) {
+	a := &authorizer.MemoryAuthorizer{}
+	require.EqualError(t, a.Check(context.Background()), "no policy loaded")
+
+	a.Update(map[spiffeid.ID][]authorizer.Route{})
+	require.NoError(t, a.Check(context.Background()))
+
+	fromFile, err := authorizer.FromFile("testconfigs/basic.hcl")
+	require.NoError(t, err)
+	require.NoError(t, fromFile.Check(context.Background()))
+}
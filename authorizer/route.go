@@ -1 +1,44 @@
 package authorizer
+
+import "strings"
+
+// MatchPath reports whether path matches pattern. A WildcardSegment matches
+// exactly one path segment, and a trailing WildcardSegments matches any
+// number of them.
+func MatchPath(pattern, path string) bool {
+	rPath := strings.TrimRight(pattern, "/")
+	parts := strings.Split(rPath, "/")
+	lastPart := len(parts) - 1
+
+	if parts[0] == WildcardSegments {
+		return true
+	}
+
+	for i, scope := range strings.Split(path, "/") {
+		if i > lastPart {
+			return parts[lastPart] == WildcardSegments
+		}
+		if parts[i] != WildcardSegment && parts[i] != WildcardSegments && parts[i] != scope {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchFullPath is like MatchPath, but path must have every segment of
+// pattern, so that a pattern never matches a shorter path. A trailing
+// WildcardSegments may match no segments at all.
+func MatchFullPath(pattern, path string) bool {
+	if !MatchPath(pattern, path) {
+		return false
+	}
+
+	parts := strings.Split(strings.TrimRight(pattern, "/"), "/")
+	segments := strings.Count(path, "/") + 1
+	if segments >= len(parts) {
+		return true
+	}
+
+	return segments == len(parts)-1 && parts[len(parts)-1] == WildcardSegments
+}
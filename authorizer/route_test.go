@@ -80,3 +80,70 @@ func TestRoute_Match(t *testing.T) {
 		})
 	})
 }
+
+func TestMatchFullPath(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		"same path": {
+			pattern: "/healthz/deep",
+			path:    "/healthz/deep",
+			want:    true,
+		},
+		"shorter path": {
+			pattern: "/healthz/deep",
+			path:    "/healthz",
+		},
+		"root": {
+			pattern: "/healthz/deep",
+			path:    "/",
+		},
+		"longer path": {
+			pattern: "/healthz",
+			path:    "/healthz/deep",
+		},
+		"wildcard segment": {
+			pattern: "/status/*",
+			path:    "/status/db",
+			want:    true,
+		},
+		"missing wildcard segment": {
+			pattern: "/status/*",
+			path:    "/status",
+		},
+		"trailing wildcard": {
+			pattern: "/docs/**",
+			path:    "/docs/a/b",
+			want:    true,
+		},
+		"trailing wildcard with no segments": {
+			pattern: "/docs/**",
+			path:    "/docs",
+			want:    true,
+		},
+		"trailing wildcard with a shorter path": {
+			pattern: "/docs/v1/**",
+			path:    "/docs",
+		},
+		"any path": {
+			pattern: "**",
+			path:    "/anything",
+			want:    true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, authorizer.MatchFullPath(tc.pattern, tc.path))
+			// MatchPath is looser, and matches shorter paths too.
+			if tc.want {
+				assert.True(t, authorizer.MatchPath(tc.pattern, tc.path))
+			}
+		})
+	}
+}
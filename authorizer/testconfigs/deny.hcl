@@ -0,0 +1,16 @@
+deny {
+  spiffeids = ["spiffe://example.org/a/leaked"]
+  serials   = ["1f"]
+}
+
+spiffeid "spiffe://example.org/a/workload" {
+  path "/foo/bar" {
+    methods = ["GET"]
+  }
+}
+
+spiffeid "spiffe://example.org/a/leaked" {
+  path "/foo/bar" {
+    methods = ["GET"]
+  }
+}
@@ -0,0 +1,16 @@
+public {
+  grpc "grpc.health.v1.Health" {
+    methods = ["Check"]
+  }
+}
+
+spiffeid "spiffe://example.org/a/workload" {
+  grpc "payments.v1.Ledger" {
+    methods = ["GetBalance", "ListTransactions"]
+  }
+
+  grpc "payments.v1.Admin" {
+    methods = ["*"]
+    auth    = "x509"
+  }
+}
@@ -0,0 +1,21 @@
+public {
+  path "/healthz" {
+    methods = ["GET"]
+  }
+}
+
+spiffeid "spiffe://example.org/a/workload" {
+  path "/upload/**" {
+    methods        = ["PUT"]
+    max_body_bytes = 104857600
+  }
+
+  path "/api/**" {
+    methods = ["POST"]
+  }
+
+  grpc "backups.v1.Backups" {
+    methods        = ["Upload"]
+    max_body_bytes = 1048576
+  }
+}
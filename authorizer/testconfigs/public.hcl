@@ -0,0 +1,15 @@
+public {
+  path "/healthz" {
+    methods = ["GET"]
+  }
+
+  path "/status/deep" {
+    methods = ["GET"]
+  }
+}
+
+spiffeid "spiffe://example.org/a/workload" {
+  path "/foo/bar" {
+    methods = ["GET"]
+  }
+}
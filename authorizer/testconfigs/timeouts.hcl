@@ -0,0 +1,22 @@
+public {
+  path "/downloads/**" {
+    methods       = ["GET"]
+    write_timeout = "10m"
+  }
+}
+
+spiffeid "spiffe://example.org/a/workload" {
+  path "/upload/**" {
+    methods      = ["PUT"]
+    read_timeout = "5m"
+  }
+
+  path "/api/**" {
+    methods = ["GET"]
+  }
+
+  grpc "backups.v1.Backups" {
+    methods       = ["Restore"]
+    write_timeout = "1h"
+  }
+}
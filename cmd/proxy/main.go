@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
 	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 	"github.com/spiffe/go-spiffe/v2/workloadapi"
 
@@ -23,6 +26,9 @@ import (
 	"jsocol.io/spiffe-authz-proxy/logutils"
 	"jsocol.io/spiffe-authz-proxy/servers/metaserver"
 	"jsocol.io/spiffe-authz-proxy/servers/proxyserver"
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil/assertion"
+	"jsocol.io/spiffe-authz-proxy/tlsutil"
+	"jsocol.io/spiffe-authz-proxy/trustbundle"
 	"jsocol.io/spiffe-authz-proxy/upstream"
 )
 
@@ -49,6 +55,10 @@ func main() {
 	}
 
 	promRegistry := prometheus.NewRegistry()
+	promRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
 
 	logger.DebugContext(startupCtx, "configured", "config", cfg)
 
@@ -57,23 +67,100 @@ func main() {
 		close(shutdownCh)
 	})
 
+	// A second signal is left on sigChan for shutdown, to skip the delay.
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sigChan
 		shutdownOnce()
 	}()
 
-	upstreamAddr, err := cfg.UpstreamAddr()
+	x509source, err := workloadapi.NewX509Source(startupCtx, workloadapi.WithClientOptions(
+		workloadapi.WithLogger(logutils.NewSPIFFEAdapter(ctx, logger.With("logger", "x509source"))),
+		workloadapi.WithAddr(cfg.WorkloadAPI),
+	))
 	if err != nil {
-		logger.ErrorContext(startupCtx, "no upstream address", "error", err)
-		os.Exit(exitCodeBadConfig)
+		logger.ErrorContext(
+			startupCtx,
+			"could not get x509 source",
+			"error", err,
+			"workloadAddr", cfg.WorkloadAPI,
+		)
+		os.Exit(exitCodeX509Source)
+	}
+
+	svid, err := x509source.GetX509SVID()
+	if err != nil {
+		logger.ErrorContext(
+			startupCtx,
+			"could not get x509 svid",
+			"error", err,
+		)
+		os.Exit(exitCodeX509Source)
+	}
+
+	spID, err := x509svid.IDFromCert(svid.Certificates[0])
+	if err != nil {
+		logger.ErrorContext(
+			startupCtx,
+			"could not get spiffe ID from svid",
+			"error", err,
+		)
 	}
 
-	up, err := upstream.New(
-		upstream.WithAddr(upstreamAddr),
-		upstream.WithMetrics(promRegistry),
+	logger.InfoContext(
+		startupCtx,
+		"got server svid",
+		"spiffeid", spID.String(),
 	)
+
+	var bundleSource x509bundle.Source = x509source
+	if cfg.FederationConfig != "" {
+		endpoints, err := trustbundle.FromFile(cfg.FederationConfig)
+		if err != nil {
+			logger.ErrorContext(
+				startupCtx,
+				"could not read federation config",
+				"error", err,
+				"federationConfig", cfg.FederationConfig,
+			)
+			os.Exit(exitCodeBadConfig)
+		}
+
+		federated := trustbundle.New(
+			x509source,
+			endpoints,
+			trustbundle.WithLogger(logger.With("logger", "trustbundle")),
+		)
+		go func() {
+			if err := federated.Run(ctx); err != nil {
+				logger.InfoContext(ctx, "stopped watching federated bundles", "error", err)
+			}
+		}()
+
+		bundleSource = federated
+
+		logger.InfoContext(startupCtx, "federating with trust domains", "count", len(endpoints))
+	}
+
+	proxyFile, err := cfg.ReadProxyFile()
+	if err != nil {
+		logger.ErrorContext(
+			startupCtx,
+			"could not read proxy config",
+			"error", err,
+			"proxyConfig", cfg.ProxyConfig,
+		)
+		os.Exit(exitCodeBadConfig)
+	}
+
+	upstreamTarget, err := cfg.UpstreamTarget()
+	if err != nil {
+		logger.ErrorContext(startupCtx, "invalid upstream config", "error", err)
+		os.Exit(exitCodeBadConfig)
+	}
+
+	up, err := newUpstream(logger, config.DefaultUpstreamName, upstreamTarget, x509source, bundleSource, promRegistry)
 	if err != nil {
 		logger.ErrorContext(
 			startupCtx,
@@ -85,6 +172,43 @@ func main() {
 	}
 
 	logger.InfoContext(startupCtx, "created upstream", "upstreamAddr", cfg.Upstream.String())
+	go runHealthChecks(ctx, logger, up)
+	upstreams := []*upstream.Upstream{up}
+
+	upstreamRoutes := make([]proxyhandler.Option, 0, len(proxyFile.Upstreams))
+	for _, route := range proxyFile.Upstreams {
+		target, err := route.Target()
+		if err != nil {
+			logger.ErrorContext(startupCtx, "invalid upstream", "error", err, "upstream", route.Name)
+			os.Exit(exitCodeBadConfig)
+		}
+
+		routeUp, err := newUpstream(logger, route.Name, target, x509source, bundleSource, promRegistry)
+		if err != nil {
+			logger.ErrorContext(
+				startupCtx,
+				"could not create upstream",
+				"error", err,
+				"upstream", route.Name,
+				"upstreamAddr", route.Addr,
+				"upstreamAddrs", route.Addrs,
+			)
+			os.Exit(exitCodeBadConfig)
+		}
+		go runHealthChecks(ctx, logger, routeUp)
+		upstreams = append(upstreams, routeUp)
+
+		upstreamRoutes = append(upstreamRoutes, proxyhandler.WithUpstreamRoute(routeUp, route.Paths...))
+
+		logger.InfoContext(
+			startupCtx,
+			"created upstream",
+			"upstream", route.Name,
+			"upstreamAddr", route.Addr,
+			"upstreamAddrs", route.Addrs,
+			"paths", route.Paths,
+		)
+	}
 
 	authzURL, err := cfg.AuthzConfigURL()
 	if err != nil {
@@ -117,7 +241,7 @@ func main() {
 		)
 		go func() {
 			if err := authz.Watch(ctx); err != nil {
-				logger.InfoContext(ctx, "error watching configmap", "error", err)
+				logger.ErrorContext(ctx, "error watching configmap", "error", err)
 			}
 		}()
 	default:
@@ -142,55 +266,86 @@ func main() {
 		"loaded authorization config",
 		"filePath", cfg.AuthzConfig,
 		"ruleCount", authz.Length(),
+		"denyListCount", authz.DenyListLength(),
 	)
 
-	proxyHandler := proxyhandler.New(
+	xfccMode, err := proxyhandler.ParseXFCCMode(cfg.XFCCMode)
+	if err != nil {
+		logger.ErrorContext(startupCtx, "invalid xfcc mode", "error", err)
+		os.Exit(exitCodeBadConfig)
+	}
+
+	forwardedMode, err := proxyhandler.ParseForwardedMode(cfg.ForwardedMode)
+	if err != nil {
+		logger.ErrorContext(startupCtx, "invalid forwarded mode", "error", err)
+		os.Exit(exitCodeBadConfig)
+	}
+
+	headerTemplates := proxyhandler.DefaultHeaderTemplates()
+	if len(proxyFile.UpstreamHeaders) > 0 {
+		headerTemplates, err = proxyhandler.ParseHeaderTemplates(proxyFile.UpstreamHeaders)
+		if err != nil {
+			logger.ErrorContext(startupCtx, "could not parse upstream headers", "error", err)
+			os.Exit(exitCodeBadConfig)
+		}
+	}
+
+	proxyOpts := []proxyhandler.Option{
 		proxyhandler.WithUpstream(up),
 		proxyhandler.WithLogger(logger.With("logger", "proxy")),
 		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithDenyList(authz),
+		proxyhandler.WithStrippedHeaders(cfg.StripHeaders...),
+		proxyhandler.WithXFCC(xfccMode, cfg.XFCCIncludeChain),
+		proxyhandler.WithForwarded(forwardedMode),
+		proxyhandler.WithHeaderTemplates(headerTemplates),
+		proxyhandler.WithFlushInterval(cfg.FlushInterval),
+		proxyhandler.WithMaxBodyBytes(cfg.MaxBodyBytes),
 		proxyhandler.WithMetrics(promRegistry),
-	)
-
-	x509source, err := workloadapi.NewX509Source(startupCtx, workloadapi.WithClientOptions(
-		workloadapi.WithLogger(logutils.NewSPIFFEAdapter(ctx, logger.With("logger", "x509source"))),
-		workloadapi.WithAddr(cfg.WorkloadAPI),
-	))
-	if err != nil {
-		logger.ErrorContext(
-			startupCtx,
-			"could not get x509 source",
-			"error", err,
-			"workloadAddr", cfg.WorkloadAPI,
-		)
-		os.Exit(exitCodeX509Source)
 	}
+	proxyOpts = append(proxyOpts, upstreamRoutes...)
 
-	svid, err := x509source.GetX509SVID()
-	if err != nil {
-		logger.ErrorContext(
-			startupCtx,
-			"could not get x509 svid",
-			"error", err,
-		)
-		os.Exit(exitCodeX509Source)
+	if len(cfg.JWTAudiences) > 0 {
+		jwtSource, err := workloadapi.NewJWTSource(startupCtx, workloadapi.WithClientOptions(
+			workloadapi.WithLogger(logutils.NewSPIFFEAdapter(ctx, logger.With("logger", "jwtsource"))),
+			workloadapi.WithAddr(cfg.WorkloadAPI),
+		))
+		if err != nil {
+			logger.ErrorContext(
+				startupCtx,
+				"could not get jwt source",
+				"error", err,
+				"workloadAddr", cfg.WorkloadAPI,
+			)
+			os.Exit(exitCodeX509Source)
+		}
+
+		proxyOpts = append(proxyOpts, proxyhandler.WithJWTAuth(jwtSource, cfg.JWTAudiences...))
+
+		logger.InfoContext(startupCtx, "jwt-svid authentication enabled", "audiences", cfg.JWTAudiences)
 	}
 
-	spID, err := x509svid.IDFromCert(svid.Certificates[0])
-	if err != nil {
-		logger.ErrorContext(
-			startupCtx,
-			"could not get spiffe ID from svid",
-			"error", err,
-		)
+	if cfg.IdentityAssertion {
+		proxyOpts = append(proxyOpts, proxyhandler.WithAssertionSigner(
+			assertion.NewSigner(x509source, cfg.IdentityAssertionTTL),
+		))
+
+		logger.InfoContext(startupCtx, "signed identity assertions enabled", "ttl", cfg.IdentityAssertionTTL)
 	}
 
-	logger.InfoContext(
-		startupCtx,
-		"got server svid",
-		"spiffeid", spID.String(),
-	)
+	proxyHandler := proxyhandler.New(proxyOpts...)
 
-	healthHandler := healthhandler.New(healthhandler.WithLogger(logger.With("logger", "health")))
+	healthOpts := []healthhandler.Option{
+		healthhandler.WithLogger(logger.With("logger", "health")),
+		healthhandler.WithReadinessCheck("svid", healthhandler.SVIDCheck(x509source)),
+		healthhandler.WithReadinessCheck("policy", authz),
+	}
+	if cfg.ReadyCheckUpstream {
+		for _, up := range upstreams {
+			healthOpts = append(healthOpts, healthhandler.WithReadinessCheck("upstream:"+up.Name(), up))
+		}
+	}
+	healthHandler := healthhandler.New(healthOpts...)
 	metricsHandler := metricshandler.New(
 		metricshandler.WithLogger(logger.With("logger", "metrics")),
 		metricshandler.WithRegistry(promRegistry),
@@ -212,53 +367,213 @@ func main() {
 		}
 	}()
 
-	go func() {
-		gracePeriod := 10 * time.Second //nolint:mnd
-		<-shutdownCh
-
-		logger.InfoContext(ctx, "shutting down healthcheck server", "gracePeriod", gracePeriod)
-
-		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
-		defer cancel()
+	logger.InfoContext(startupCtx, "x509 source connected", "workloadAddr", cfg.WorkloadAPI)
 
-		if err := metaSrv.Shutdown(ctx); err != nil {
-			logger.ErrorContext(ctx, "error shutting down healthcheck server", "error", err)
-		}
-	}()
+	trustDomains, err := cfg.TrustDomains()
+	if err != nil {
+		logger.ErrorContext(startupCtx, "could not parse allowed trust domains", "error", err)
+		os.Exit(exitCodeBadConfig)
+	}
 
-	logger.InfoContext(startupCtx, "x509 source connected", "workloadAddr", cfg.WorkloadAPI)
+	handshakeOpts := []tlsutil.Option{
+		tlsutil.WithTrustDomains(trustDomains...),
+		tlsutil.WithDenyList(authz),
+		tlsutil.WithMetrics(promRegistry),
+	}
+	if cfg.AllowedIDsFromPolicy {
+		handshakeOpts = append(handshakeOpts, tlsutil.WithKnownIDs(authz))
+	}
+	handshakeAuthz := tlsutil.NewHandshakeAuthorizer(handshakeOpts...)
 
-	tlsConfig := tlsconfig.MTLSServerConfig(x509source, x509source, tlsconfig.AuthorizeAny())
+	// Client SVIDs are requested but not required, so that routes in the
+	// policy's public block can be reached without one. Every other route
+	// still requires an SVID, which the proxy handler enforces.
+	tlsConfig := tlsutil.OptionalMTLSServerConfig(x509source, bundleSource, handshakeAuthz.TLSAuthorizer())
 
 	proxyServer := proxyserver.New(
 		proxyserver.WithAddr(cfg.BindAddr),
 		proxyserver.WithProxyHandler(proxyHandler),
 		proxyserver.WithTLSConfig(tlsConfig),
+		proxyserver.WithReadTimeout(cfg.ServerReadTimeout),
+		proxyserver.WithReadHeaderTimeout(cfg.ServerHeaderTimeout),
+		proxyserver.WithWriteTimeout(cfg.ServerWriteTimeout),
+		proxyserver.WithIdleTimeout(cfg.ServerIdleTimeout),
+		proxyserver.WithMaxHeaderBytes(cfg.ServerMaxHeaderBytes),
 		proxyserver.WithMetrics(promRegistry),
 	)
+	// Shutdown doesn't track hijacked connections, like WebSockets, so
+	// they're closed by the proxy once draining starts.
+	proxyServer.RegisterOnShutdown(proxyHandler.CloseUpgraded)
 
 	startupCancel()
 
+	shutdownDone := make(chan struct{})
 	go func() {
-		gracePeriod := 10 * time.Second //nolint:mnd
+		defer close(shutdownDone)
 		<-shutdownCh
 
-		logger.InfoContext(ctx, "shutting down proxy server", "gracePeriod", gracePeriod)
+		shutdown(ctx, logger, &shutdownSequence{
+			health:      healthHandler,
+			signals:     sigChan,
+			delay:       cfg.ShutdownDelay,
+			gracePeriod: cfg.ShutdownGracePeriod,
+			proxy:       proxyServer,
+			meta:        metaSrv,
+			upstreams:   upstreams,
+		})
+	}()
 
-		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
-		defer cancel()
+	// The proxy is only started once it can accept connections.
+	listener, err := net.Listen("tcp", proxyServer.Addr)
+	if err != nil {
+		logger.Error("error starting proxy server", "error", err)
+		os.Exit(exitCodeServerError)
+	}
 
-		err := proxyServer.Shutdown(ctx)
-		if err != nil {
-			logger.ErrorContext(ctx, "error shutting down proxy server", "error", err)
-		}
-	}()
+	healthHandler.Started()
 
-	logger.InfoContext(ctx, "starting proxy server", "addr", proxyServer.Addr)
-	if err := proxyServer.ListenAndServeTLS("", ""); err != nil {
+	logger.InfoContext(ctx, "starting proxy server", "addr", listener.Addr().String())
+	if err := proxyServer.ServeTLS(listener, "", ""); err != nil {
 		if err != http.ErrServerClosed {
 			logger.Error("error starting proxy server", "error", err)
 			os.Exit(exitCodeServerError)
 		}
 	}
+
+	// ServeTLS returns as soon as the shutdown starts draining, so
+	// wait for it to finish.
+	<-shutdownDone
+}
+
+// shutdownSequence is what shutdown needs to stop the proxy.
+type shutdownSequence struct {
+	health      *healthhandler.Health
+	signals     <-chan os.Signal
+	delay       time.Duration
+	gracePeriod time.Duration
+	proxy       *http.Server
+	meta        *http.Server
+	upstreams   []*upstream.Upstream
+}
+
+// shutdown stops the proxy without dropping requests. It marks the proxy as
+// not ready, then keeps serving for the pre-stop delay while load balancers
+// and service discovery stop sending it requests, unless another signal
+// arrives or ctx is done first. Then it waits up to the grace period for
+// in-flight requests to finish, closes the now idle upstream connections, and
+// finally stops the meta server.
+func shutdown(ctx context.Context, logger *slog.Logger, s *shutdownSequence) {
+	logger.InfoContext(ctx, "shutting down, marking not ready", "delay", s.delay)
+	s.health.Drain()
+
+	select {
+	case <-time.After(s.delay):
+	case sig := <-s.signals:
+		logger.InfoContext(ctx, "received another signal, skipping the delay", "signal", sig.String())
+	case <-ctx.Done():
+	}
+
+	logger.InfoContext(ctx, "draining proxy requests", "gracePeriod", s.gracePeriod)
+	drainCtx, cancel := context.WithTimeout(ctx, s.gracePeriod)
+	defer cancel()
+
+	if err := s.proxy.Shutdown(drainCtx); err != nil {
+		logger.ErrorContext(ctx, "proxy requests didn't finish in time, closing connections", "error", err)
+		_ = s.proxy.Close()
+	}
+
+	logger.InfoContext(ctx, "closing idle upstream connections", "upstreams", len(s.upstreams))
+	for _, up := range s.upstreams {
+		up.CloseIdleConnections()
+	}
+
+	logger.InfoContext(ctx, "shutting down meta server")
+	metaCtx, cancel := context.WithTimeout(ctx, s.gracePeriod)
+	defer cancel()
+
+	if err := s.meta.Shutdown(metaCtx); err != nil {
+		logger.ErrorContext(ctx, "error shutting down meta server", "error", err)
+	}
+
+	logger.InfoContext(ctx, "shutdown complete")
+}
+
+// newUpstream creates the upstream for target. Upstreams with an https
+// address present the proxy's X509-SVID and verify the server against
+// bundles or Web PKI, depending on target.
+func newUpstream(
+	logger *slog.Logger,
+	name string,
+	target *config.UpstreamTarget,
+	svids x509svid.Source,
+	bundles x509bundle.Source,
+	reg prometheus.Registerer,
+) (*upstream.Upstream, error) {
+	addrs, err := target.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []upstream.Option{
+		upstream.WithName(name),
+		upstream.WithBalancer(target.Balancer),
+		upstream.WithTimeout(target.Timeout),
+		upstream.WithConnectionPool(target.ConnectionPool),
+		upstream.WithLogger(logger.With("logger", "upstream", "upstream", name)),
+		upstream.WithMetrics(reg),
+	}
+
+	// Addrs resolves the URLs in order, so each address has the same index
+	// as the URL it came from.
+	for i, addr := range addrs {
+		opts = append(opts, upstream.WithEndpoint(addr, target.URLs[i].Host))
+	}
+
+	if target.HealthCheck != nil {
+		opts = append(opts, upstream.WithHealthCheck(*target.HealthCheck))
+	}
+
+	if target.PassiveHealthCheck != nil {
+		opts = append(opts, upstream.WithPassiveHealthCheck(*target.PassiveHealthCheck))
+	}
+
+	if target.Retry != nil {
+		opts = append(opts, upstream.WithRoundTripperWrappers(upstream.Retry(*target.Retry)))
+	}
+
+	if target.CircuitBreaker != nil {
+		opts = append(opts, upstream.WithCircuitBreaker(*target.CircuitBreaker))
+	}
+
+	if target.HTTP2 {
+		opts = append(opts, upstream.WithHTTP2())
+	}
+
+	if target.TLS() {
+		authz, err := target.Authorizer()
+		if err != nil {
+			return nil, err
+		}
+
+		roots, err := target.RootCAs()
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, upstream.WithTLSConfig(tlsutil.UpstreamClientConfig(
+			svids,
+			bundles,
+			authz,
+			roots,
+			target.ServerName(),
+		)))
+	}
+
+	return upstream.New(opts...)
+}
+
+func runHealthChecks(ctx context.Context, logger *slog.Logger, up *upstream.Upstream) {
+	if err := up.Run(ctx); err != nil {
+		logger.InfoContext(ctx, "stopped upstream health checks", "error", err, "upstream", up.Name())
+	}
 }
@@ -4,34 +4,119 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"jsocol.io/spiffe-authz-proxy/upstream"
 )
 
 type Config struct {
-	LogLevel    string   `env:"LOG_LEVEL, default=info"`
-	LogFormat   string   `env:"LOG_FORMAT, default=json"`
-	BindAddr    string   `env:"BIND_ADDR, default=:8443"`
-	MetaAddr    string   `env:"META_ADDR, default=:8081"`
-	WorkloadAPI string   `env:"WORKLOAD_API, default=unix:///tmp/spire-agent/public/agent.sock"`
-	AuthzConfig string   `env:"AUTHZ_CONFIG, required"`
-	Upstream    *url.URL `env:"UPSTREAM_ADDR, default=tcp://127.0.0.1:8000"`
+	LogLevel             string        `env:"LOG_LEVEL, default=info"`
+	LogFormat            string        `env:"LOG_FORMAT, default=json"`
+	BindAddr             string        `env:"BIND_ADDR, default=:8443"`
+	MetaAddr             string        `env:"META_ADDR, default=:8081"`
+	ServerReadTimeout    time.Duration `env:"SERVER_READ_TIMEOUT, default=60s"`
+	ServerHeaderTimeout  time.Duration `env:"SERVER_READ_HEADER_TIMEOUT, default=10s"`
+	ServerWriteTimeout   time.Duration `env:"SERVER_WRITE_TIMEOUT"`
+	ServerIdleTimeout    time.Duration `env:"SERVER_IDLE_TIMEOUT, default=120s"`
+	ServerMaxHeaderBytes int           `env:"SERVER_MAX_HEADER_BYTES, default=1048576"`
+	WorkloadAPI          string        `env:"WORKLOAD_API, default=unix:///tmp/spire-agent/public/agent.sock"`
+	AuthzConfig          string        `env:"AUTHZ_CONFIG, required"`
+	Upstream             *url.URL      `env:"UPSTREAM_ADDR, default=tcp://127.0.0.1:8000"`
+	JWTAudiences         []string      `env:"JWT_AUDIENCES"`
+	AllowedTrustDomains  []string      `env:"ALLOWED_TRUST_DOMAINS"`
+	AllowedIDsFromPolicy bool          `env:"ALLOWED_IDS_FROM_POLICY, default=false"`
+	FederationConfig     string        `env:"FEDERATION_CONFIG"`
+	StripHeaders         []string      `env:"STRIP_HEADERS"`
+	XFCCMode             string        `env:"XFCC_MODE, default=sanitize"`
+	XFCCIncludeChain     bool          `env:"XFCC_INCLUDE_CHAIN, default=false"`
+	ForwardedMode        string        `env:"FORWARDED_MODE, default=replace"`
+	ProxyConfig          string        `env:"PROXY_CONFIG"`
+	IdentityAssertion    bool          `env:"IDENTITY_ASSERTION, default=false"`
+	IdentityAssertionTTL time.Duration `env:"IDENTITY_ASSERTION_TTL, default=30s"`
+	UpstreamSPIFFEID     string        `env:"UPSTREAM_SPIFFE_ID"`
+	UpstreamTrustDomain  string        `env:"UPSTREAM_TRUST_DOMAIN"`
+	UpstreamCAFile       string        `env:"UPSTREAM_CA_FILE"`
+	UpstreamTimeout      time.Duration `env:"UPSTREAM_TIMEOUT"`
+	UpstreamHTTP2        bool          `env:"UPSTREAM_HTTP2, default=false"`
+	UpstreamMaxIdle      int           `env:"UPSTREAM_MAX_IDLE_CONNS_PER_ENDPOINT, default=32"`
+	UpstreamIdleTimeout  time.Duration `env:"UPSTREAM_IDLE_CONN_TIMEOUT, default=90s"`
+	UpstreamKeepAlive    time.Duration `env:"UPSTREAM_KEEP_ALIVE, default=30s"`
+	UpstreamHeaderTime   time.Duration `env:"UPSTREAM_RESPONSE_HEADER_TIMEOUT"`
+	UpstreamRetries      int           `env:"UPSTREAM_RETRY_ATTEMPTS, default=1"`
+	UpstreamRetryBackoff time.Duration `env:"UPSTREAM_RETRY_BACKOFF, default=25ms"`
+	UpstreamRetryOn      string        `env:"UPSTREAM_RETRY_ON, default=idempotent"`
+	UpstreamRetryMaxBody int64         `env:"UPSTREAM_RETRY_MAX_BODY_BYTES, default=65536"`
+	UpstreamBreaker      bool          `env:"UPSTREAM_CIRCUIT_BREAKER, default=false"`
+	BreakerErrorRate     float64       `env:"UPSTREAM_CIRCUIT_BREAKER_ERROR_RATE, default=0.5"`
+	BreakerSlowRequest   time.Duration `env:"UPSTREAM_CIRCUIT_BREAKER_SLOW_REQUEST"`
+	BreakerOpenTime      time.Duration `env:"UPSTREAM_CIRCUIT_BREAKER_OPEN_DURATION, default=30s"`
+	FlushInterval        time.Duration `env:"FLUSH_INTERVAL, default=100ms"`
+	MaxBodyBytes         int64         `env:"MAX_BODY_BYTES"`
+	ShutdownDelay        time.Duration `env:"SHUTDOWN_DELAY, default=5s"`
+	ShutdownGracePeriod  time.Duration `env:"SHUTDOWN_GRACE_PERIOD, default=10s"`
+	ReadyCheckUpstream   bool          `env:"READY_CHECK_UPSTREAM, default=false"`
+}
+
+// UpstreamTarget returns the default upstream, from UPSTREAM_ADDR and the
+// other UPSTREAM_* settings.
+func (c *Config) UpstreamTarget() (*UpstreamTarget, error) {
+	target := &UpstreamTarget{
+		URLs:        []*url.URL{c.Upstream},
+		SPIFFEID:    c.UpstreamSPIFFEID,
+		TrustDomain: c.UpstreamTrustDomain,
+		CAFile:      c.UpstreamCAFile,
+		Timeout:     c.UpstreamTimeout,
+		HTTP2:       c.UpstreamHTTP2,
+		ConnectionPool: upstream.ConnectionPool{
+			MaxIdlePerEndpoint:    c.UpstreamMaxIdle,
+			IdleTimeout:           c.UpstreamIdleTimeout,
+			KeepAlive:             c.UpstreamKeepAlive,
+			ResponseHeaderTimeout: c.UpstreamHeaderTime,
+		},
+	}
+
+	if c.UpstreamRetries > 1 {
+		on, err := upstream.ParseRetryOn(c.UpstreamRetryOn)
+		if err != nil {
+			return nil, err
+		}
+
+		target.Retry = &upstream.RetryPolicy{
+			MaxAttempts:  c.UpstreamRetries,
+			Backoff:      c.UpstreamRetryBackoff,
+			On:           on,
+			MaxBodyBytes: c.UpstreamRetryMaxBody,
+		}
+	}
+
+	if c.UpstreamBreaker {
+		target.CircuitBreaker = &upstream.CircuitBreaker{
+			ErrorRate:    c.BreakerErrorRate,
+			SlowRequest:  c.BreakerSlowRequest,
+			OpenDuration: c.BreakerOpenTime,
+		}
+	}
+
+	return target, nil
 }
 
 func (c *Config) UpstreamAddr() (net.Addr, error) {
-	switch c.Upstream.Scheme {
-	case "tcp":
-		return net.ResolveTCPAddr("tcp", c.Upstream.Host)
-	case "tcp4":
-		return net.ResolveTCPAddr("tcp4", c.Upstream.Host)
-	case "tcp6":
-		return net.ResolveTCPAddr("tcp6", c.Upstream.Host)
-	case "unix":
-		return &net.UnixAddr{
-			Net:  "unix",
-			Name: c.Upstream.Path,
-		}, nil
-	default:
-		return nil, fmt.Errorf("unsupported upstream scheme: %s", c.Upstream.Scheme)
+	return upstreamAddr(c.Upstream)
+}
+
+func (c *Config) TrustDomains() ([]spiffeid.TrustDomain, error) {
+	tds := make([]spiffeid.TrustDomain, 0, len(c.AllowedTrustDomains))
+	for _, s := range c.AllowedTrustDomains {
+		td, err := spiffeid.TrustDomainFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust domain %q: %w", s, err)
+		}
+		tds = append(tds, td)
 	}
+
+	return tds, nil
 }
 
 func (c *Config) AuthzConfigURL() (*url.URL, error) {
@@ -4,12 +4,17 @@ import (
 	"net"
 	"net/netip"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"jsocol.io/spiffe-authz-proxy/config"
+	"jsocol.io/spiffe-authz-proxy/upstream"
 )
 
 func TestConfig_UpstreamAddr(t *testing.T) {
@@ -69,6 +74,34 @@ func TestConfig_UpstreamAddr(t *testing.T) {
 		assert.Equal(t, expected.String(), actual.String())
 	})
 
+	t.Run("https/default port", func(t *testing.T) {
+		u, _ := url.Parse("https://127.0.0.1")
+		cfg := &config.Config{
+			Upstream: u,
+		}
+
+		actual, err := cfg.UpstreamAddr()
+		require.NoError(t, err)
+
+		assert.Equal(t, "127.0.0.1:443", actual.String())
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+		assert.True(t, target.TLS())
+	})
+
+	t.Run("https/port", func(t *testing.T) {
+		u, _ := url.Parse("https://127.0.0.1:9443")
+		cfg := &config.Config{
+			Upstream: u,
+		}
+
+		actual, err := cfg.UpstreamAddr()
+		require.NoError(t, err)
+
+		assert.Equal(t, "127.0.0.1:9443", actual.String())
+	})
+
 	t.Run("unix", func(t *testing.T) {
 		unix, _ := url.Parse("unix:/tmp/my/socket")
 		cfg := &config.Config{
@@ -85,3 +118,376 @@ func TestConfig_UpstreamAddr(t *testing.T) {
 		assert.Equal(t, expected, actual)
 	})
 }
+
+func TestConfig_TrustDomains(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		cfg := &config.Config{}
+
+		tds, err := cfg.TrustDomains()
+		require.NoError(t, err)
+		assert.Empty(t, tds)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		cfg := &config.Config{
+			AllowedTrustDomains: []string{"example.org", "spiffe://partner.example"},
+		}
+
+		tds, err := cfg.TrustDomains()
+		require.NoError(t, err)
+		assert.Equal(t, []spiffeid.TrustDomain{
+			spiffeid.RequireTrustDomainFromString("example.org"),
+			spiffeid.RequireTrustDomainFromString("partner.example"),
+		}, tds)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		cfg := &config.Config{
+			AllowedTrustDomains: []string{"Not A Domain"},
+		}
+
+		_, err := cfg.TrustDomains()
+		require.Error(t, err)
+	})
+}
+
+func TestConfig_ReadProxyFile(t *testing.T) {
+	t.Run("no file", func(t *testing.T) {
+		cfg := &config.Config{}
+
+		pf, err := cfg.ReadProxyFile()
+		require.NoError(t, err)
+		assert.Empty(t, pf.UpstreamHeaders)
+	})
+
+	t.Run("upstream headers", func(t *testing.T) {
+		cfg := &config.Config{
+			ProxyConfig: "testdata/proxy.hcl",
+		}
+
+		pf, err := cfg.ReadProxyFile()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"Spiffe-Id":          "{{ id }}",
+			"X-Caller-Namespace": "{{ segment 1 }}",
+		}, pf.UpstreamHeaders)
+	})
+
+	t.Run("upstreams", func(t *testing.T) {
+		cfg := &config.Config{
+			ProxyConfig: "testdata/upstreams.hcl",
+		}
+
+		pf, err := cfg.ReadProxyFile()
+		require.NoError(t, err)
+		require.Len(t, pf.Upstreams, 2)
+
+		admin := pf.Upstreams[0]
+		assert.Equal(t, "admin", admin.Name)
+		assert.Equal(t, []string{"/admin/**"}, admin.Paths)
+
+		target, err := admin.Target()
+		require.NoError(t, err)
+		addrs, err := target.Addrs()
+		require.NoError(t, err)
+		require.Len(t, addrs, 1)
+		assert.Equal(t, "unix", addrs[0].Network())
+		assert.Equal(t, "/run/admin.sock", addrs[0].String())
+		assert.False(t, target.TLS())
+		assert.Equal(t, upstream.RoundRobin, target.Balancer)
+		assert.Nil(t, target.HealthCheck)
+		assert.False(t, target.HTTP2)
+
+		reports := pf.Upstreams[1]
+		assert.Equal(t, "reports", reports.Name)
+		assert.Equal(t, []string{"/reports/**", "/exports/*"}, reports.Paths)
+
+		target, err = reports.Target()
+		require.NoError(t, err)
+		assert.True(t, target.TLS())
+		assert.True(t, target.HTTP2)
+		authz, err := target.Authorizer()
+		require.NoError(t, err)
+		require.NoError(t, authz(spiffeid.RequireFromString("spiffe://example.org/reports"), nil))
+	})
+
+	t.Run("invalid upstream names", func(t *testing.T) {
+		tests := map[string]string{
+			"duplicate": `upstream "admin" {
+  addr  = "unix:///run/admin.sock"
+  paths = ["/admin/**"]
+}
+
+upstream "admin" {
+  addr  = "unix:///run/other.sock"
+  paths = ["/other/**"]
+}`,
+			"default": `upstream "default" {
+  addr  = "unix:///run/admin.sock"
+  paths = ["/admin/**"]
+}`,
+			"empty": `upstream "" {
+  addr  = "unix:///run/admin.sock"
+  paths = ["/admin/**"]
+}`,
+		}
+
+		for name, src := range tests {
+			t.Run(name, func(t *testing.T) {
+				fileName := filepath.Join(t.TempDir(), "proxy.hcl")
+				require.NoError(t, os.WriteFile(fileName, []byte(src), 0o600))
+
+				cfg := &config.Config{
+					ProxyConfig: fileName,
+				}
+
+				_, err := cfg.ReadProxyFile()
+				require.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("balanced upstream", func(t *testing.T) {
+		cfg := &config.Config{
+			ProxyConfig: "testdata/balanced.hcl",
+		}
+
+		pf, err := cfg.ReadProxyFile()
+		require.NoError(t, err)
+		require.Len(t, pf.Upstreams, 1)
+
+		target, err := pf.Upstreams[0].Target()
+		require.NoError(t, err)
+
+		addrs, err := target.Addrs()
+		require.NoError(t, err)
+		assert.Len(t, addrs, 3)
+		assert.Equal(t, upstream.LeastRequest, target.Balancer)
+		assert.Equal(t, 15*time.Second, target.Timeout)
+		assert.Equal(t, &upstream.HealthCheck{
+			Path:               "/healthz",
+			Interval:           5 * time.Second,
+			Timeout:            time.Second,
+			UnhealthyThreshold: 2,
+		}, target.HealthCheck)
+		assert.Equal(t, &upstream.PassiveHealthCheck{
+			ConsecutiveFailures: 3,
+			EjectionTime:        time.Minute,
+		}, target.PassiveHealthCheck)
+		assert.Equal(t, &upstream.RetryPolicy{
+			MaxAttempts: 4,
+			Backoff:     10 * time.Millisecond,
+			On:          upstream.RetryConnectionErrors,
+		}, target.Retry)
+		assert.Equal(t, &upstream.CircuitBreaker{
+			ErrorRate:    0.25,
+			SlowRequest:  500 * time.Millisecond,
+			OpenDuration: 10 * time.Second,
+		}, target.CircuitBreaker)
+		assert.Equal(t, upstream.ConnectionPool{
+			MaxIdlePerEndpoint:    64,
+			IdleTimeout:           2 * time.Minute,
+			ResponseHeaderTimeout: 30 * time.Second,
+		}, target.ConnectionPool)
+	})
+
+	t.Run("mixed tls", func(t *testing.T) {
+		route := &config.UpstreamRoute{
+			Name:  "mixed",
+			Addrs: []string{"tcp://127.0.0.1:8000", "https://127.0.0.1:8443"},
+			Paths: []string{"**"},
+		}
+
+		target, err := route.Target()
+		require.NoError(t, err)
+
+		_, err = target.Addrs()
+		require.Error(t, err)
+	})
+
+	t.Run("duplicate addrs", func(t *testing.T) {
+		route := &config.UpstreamRoute{
+			Name:  "app",
+			Addr:  "tcp://127.0.0.1:8000",
+			Addrs: []string{"tcp://127.0.0.1:8001", "tcp://127.0.0.1:8000"},
+			Paths: []string{"**"},
+		}
+
+		_, err := route.Target()
+		require.ErrorContains(t, err, "duplicate address")
+	})
+
+	t.Run("no addr", func(t *testing.T) {
+		route := &config.UpstreamRoute{
+			Name:  "empty",
+			Paths: []string{"**"},
+		}
+
+		_, err := route.Target()
+		require.Error(t, err)
+	})
+}
+
+func TestConfig_UpstreamTarget(t *testing.T) {
+	u, _ := url.Parse("tcp://127.0.0.1:8000")
+
+	t.Run("no retries", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:        u,
+			UpstreamRetries: 1,
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+		assert.Nil(t, target.Retry)
+		assert.Nil(t, target.CircuitBreaker)
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:             u,
+			UpstreamRetries:      3,
+			UpstreamRetryBackoff: 50 * time.Millisecond,
+			UpstreamRetryOn:      "idempotent",
+			UpstreamRetryMaxBody: 1024,
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+		assert.Equal(t, &upstream.RetryPolicy{
+			MaxAttempts:  3,
+			Backoff:      50 * time.Millisecond,
+			On:           upstream.RetryIdempotent,
+			MaxBodyBytes: 1024,
+		}, target.Retry)
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:         u,
+			UpstreamBreaker:  true,
+			BreakerErrorRate: 0.5,
+			BreakerOpenTime:  30 * time.Second,
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+		assert.Equal(t, &upstream.CircuitBreaker{
+			ErrorRate:    0.5,
+			OpenDuration: 30 * time.Second,
+		}, target.CircuitBreaker)
+	})
+
+	t.Run("connection pool", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:            u,
+			UpstreamMaxIdle:     32,
+			UpstreamIdleTimeout: 90 * time.Second,
+			UpstreamKeepAlive:   30 * time.Second,
+			UpstreamHeaderTime:  5 * time.Second,
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+		assert.Equal(t, upstream.ConnectionPool{
+			MaxIdlePerEndpoint:    32,
+			IdleTimeout:           90 * time.Second,
+			KeepAlive:             30 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second,
+		}, target.ConnectionPool)
+	})
+
+	t.Run("invalid retry on", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:        u,
+			UpstreamRetries: 3,
+			UpstreamRetryOn: "always",
+		}
+
+		_, err := cfg.UpstreamTarget()
+		require.Error(t, err)
+	})
+	t.Run("no authorizer", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream: u,
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+		assert.False(t, target.TLS())
+
+		authz, err := target.Authorizer()
+		require.NoError(t, err)
+		assert.Nil(t, authz)
+	})
+
+	t.Run("spiffe id", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:         u,
+			UpstreamSPIFFEID: "spiffe://example.org/app",
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+
+		authz, err := target.Authorizer()
+		require.NoError(t, err)
+		require.NoError(t, authz(spiffeid.RequireFromString("spiffe://example.org/app"), nil))
+		require.Error(t, authz(spiffeid.RequireFromString("spiffe://example.org/other"), nil))
+	})
+
+	t.Run("trust domain", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:            u,
+			UpstreamTrustDomain: "example.org",
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+
+		authz, err := target.Authorizer()
+		require.NoError(t, err)
+		require.NoError(t, authz(spiffeid.RequireFromString("spiffe://example.org/app"), nil))
+		require.Error(t, authz(spiffeid.RequireFromString("spiffe://other.example/app"), nil))
+	})
+
+	t.Run("spiffe id and trust domain", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:            u,
+			UpstreamSPIFFEID:    "spiffe://example.org/app",
+			UpstreamTrustDomain: "example.org",
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+
+		_, err = target.Authorizer()
+		require.Error(t, err)
+	})
+
+	t.Run("system roots", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream: u,
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+
+		roots, err := target.RootCAs()
+		require.NoError(t, err)
+		assert.Nil(t, roots)
+	})
+
+	t.Run("missing ca file", func(t *testing.T) {
+		cfg := &config.Config{
+			Upstream:       u,
+			UpstreamCAFile: filepath.Join(t.TempDir(), "ca.pem"),
+		}
+
+		target, err := cfg.UpstreamTarget()
+		require.NoError(t, err)
+
+		_, err = target.RootCAs()
+		require.Error(t, err)
+	})
+}
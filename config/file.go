@@ -0,0 +1,333 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hclsimple"
+
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+// ProxyFile holds settings that are too structured for environment
+// variables. It is read from the HCL or JSON file named by PROXY_CONFIG.
+type ProxyFile struct {
+	// UpstreamHeaders maps header names to templates that are evaluated
+	// against the caller's verified identity.
+	UpstreamHeaders map[string]string `hcl:"upstream_headers,optional"`
+	// Upstreams route requests for some paths to other upstreams. Requests
+	// that match none of them go to UPSTREAM_ADDR.
+	Upstreams []UpstreamRoute `hcl:"upstream,block"`
+}
+
+// DefaultUpstreamName names the upstream at UPSTREAM_ADDR, in logs and in the
+// upstream label of metrics. Upstream blocks can't use it.
+const DefaultUpstreamName = "default"
+
+// ReadProxyFile reads the proxy config file. Without PROXY_CONFIG, it returns
+// an empty ProxyFile.
+func (c *Config) ReadProxyFile() (*ProxyFile, error) {
+	pf := &ProxyFile{}
+	if c.ProxyConfig == "" {
+		return pf, nil
+	}
+
+	if err := hclsimple.DecodeFile(c.ProxyConfig, nil, pf); err != nil {
+		return nil, err
+	}
+
+	if err := pf.checkUpstreamNames(); err != nil {
+		return nil, err
+	}
+
+	return pf, nil
+}
+
+// checkUpstreamNames returns an error unless every upstream block has its own
+// name, since each upstream's metrics are labeled with it.
+func (pf *ProxyFile) checkUpstreamNames() error {
+	seen := make(map[string]bool, len(pf.Upstreams))
+	for _, route := range pf.Upstreams {
+		switch {
+		case route.Name == "":
+			return errors.New("upstream blocks need a name")
+		case route.Name == DefaultUpstreamName:
+			return fmt.Errorf("upstream name %q is reserved for UPSTREAM_ADDR", DefaultUpstreamName)
+		case seen[route.Name]:
+			return fmt.Errorf("more than one upstream is named %q", route.Name)
+		}
+		seen[route.Name] = true
+	}
+
+	return nil
+}
+
+// UpstreamRoute is an upstream block, which sends requests for any of Paths
+// to the upstream at Addr, or balances them across Addrs. Paths use the same
+// patterns as the authorization policy.
+type UpstreamRoute struct {
+	Name               string              `hcl:"name,label"`
+	Addr               string              `hcl:"addr,optional"`
+	Addrs              []string            `hcl:"addrs,optional"`
+	Paths              []string            `hcl:"paths"`
+	SPIFFEID           string              `hcl:"spiffe_id,optional"`
+	TrustDomain        string              `hcl:"trust_domain,optional"`
+	CAFile             string              `hcl:"ca_file,optional"`
+	Timeout            string              `hcl:"timeout,optional"`
+	HTTP2              bool                `hcl:"http2,optional"`
+	Balancer           string              `hcl:"balancer,optional"`
+	HealthCheck        *HealthCheck        `hcl:"health_check,block"`
+	PassiveHealthCheck *PassiveHealthCheck `hcl:"passive_health_check,block"`
+	Retry              *Retry              `hcl:"retry,block"`
+	CircuitBreaker     *CircuitBreaker     `hcl:"circuit_breaker,block"`
+	ConnectionPool     *ConnectionPool     `hcl:"connection_pool,block"`
+}
+
+// HealthCheck is a health_check block, which enables active health checks of
+// each of an upstream's endpoints. Durations use time.ParseDuration syntax.
+type HealthCheck struct {
+	Path               string `hcl:"path"`
+	Interval           string `hcl:"interval,optional"`
+	Timeout            string `hcl:"timeout,optional"`
+	HealthyThreshold   int    `hcl:"healthy_threshold,optional"`
+	UnhealthyThreshold int    `hcl:"unhealthy_threshold,optional"`
+}
+
+// PassiveHealthCheck is a passive_health_check block, which ejects endpoints
+// whose requests keep failing.
+type PassiveHealthCheck struct {
+	ConsecutiveFailures int    `hcl:"consecutive_failures,optional"`
+	EjectionTime        string `hcl:"ejection_time,optional"`
+}
+
+// Retry is a retry block, which sends failed requests to an upstream again.
+type Retry struct {
+	Attempts     int    `hcl:"attempts,optional"`
+	Backoff      string `hcl:"backoff,optional"`
+	MaxBackoff   string `hcl:"max_backoff,optional"`
+	On           string `hcl:"on,optional"`
+	MaxBodyBytes int64  `hcl:"max_body_bytes,optional"`
+}
+
+// CircuitBreaker is a circuit_breaker block, which stops sending requests to
+// a failing or slow upstream.
+type CircuitBreaker struct {
+	Window           string  `hcl:"window,optional"`
+	MinRequests      int     `hcl:"min_requests,optional"`
+	ErrorRate        float64 `hcl:"error_rate,optional"`
+	SlowRequest      string  `hcl:"slow_request,optional"`
+	SlowRate         float64 `hcl:"slow_rate,optional"`
+	OpenDuration     string  `hcl:"open_duration,optional"`
+	HalfOpenRequests int     `hcl:"half_open_requests,optional"`
+}
+
+// ConnectionPool is a connection_pool block, which changes how connections
+// to the upstream are kept open and reused.
+type ConnectionPool struct {
+	MaxIdlePerEndpoint    int    `hcl:"max_idle_per_endpoint,optional"`
+	IdleTimeout           string `hcl:"idle_timeout,optional"`
+	KeepAlive             string `hcl:"keep_alive,optional"`
+	ResponseHeaderTimeout string `hcl:"response_header_timeout,optional"`
+}
+
+// Target parses the upstream's addresses, TLS settings, and balancing.
+func (r *UpstreamRoute) Target() (*UpstreamTarget, error) {
+	addrs := r.Addrs
+	if r.Addr != "" {
+		addrs = append([]string{r.Addr}, addrs...)
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("upstream %q needs addr or addrs", r.Name)
+	}
+
+	urls := make([]*url.URL, 0, len(addrs))
+	for i, addr := range addrs {
+		if slices.Contains(addrs[:i], addr) {
+			return nil, fmt.Errorf("duplicate address %s for upstream %q", addr, r.Name)
+		}
+
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address for upstream %q: %w", r.Name, err)
+		}
+		urls = append(urls, u)
+	}
+
+	balancer, err := upstream.ParseBalancer(r.Balancer)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", r.Name, err)
+	}
+
+	timeout, err := parseOptionalDuration(r.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout for upstream %q: %w", r.Name, err)
+	}
+
+	target := &UpstreamTarget{
+		URLs:        urls,
+		SPIFFEID:    r.SPIFFEID,
+		TrustDomain: r.TrustDomain,
+		CAFile:      r.CAFile,
+		Timeout:     timeout,
+		HTTP2:       r.HTTP2,
+		Balancer:    balancer,
+	}
+
+	if r.HealthCheck != nil {
+		target.HealthCheck, err = r.HealthCheck.parse()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", r.Name, err)
+		}
+	}
+
+	if r.PassiveHealthCheck != nil {
+		target.PassiveHealthCheck, err = r.PassiveHealthCheck.parse()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", r.Name, err)
+		}
+	}
+
+	if r.Retry != nil {
+		target.Retry, err = r.Retry.parse()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", r.Name, err)
+		}
+	}
+
+	if r.CircuitBreaker != nil {
+		target.CircuitBreaker, err = r.CircuitBreaker.parse()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", r.Name, err)
+		}
+	}
+
+	if r.ConnectionPool != nil {
+		target.ConnectionPool, err = r.ConnectionPool.parse()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", r.Name, err)
+		}
+	}
+
+	return target, nil
+}
+
+func (h *HealthCheck) parse() (*upstream.HealthCheck, error) {
+	interval, err := parseOptionalDuration(h.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check interval: %w", err)
+	}
+
+	timeout, err := parseOptionalDuration(h.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check timeout: %w", err)
+	}
+
+	return &upstream.HealthCheck{
+		Path:               h.Path,
+		Interval:           interval,
+		Timeout:            timeout,
+		HealthyThreshold:   h.HealthyThreshold,
+		UnhealthyThreshold: h.UnhealthyThreshold,
+	}, nil
+}
+
+func (p *PassiveHealthCheck) parse() (*upstream.PassiveHealthCheck, error) {
+	ejection, err := parseOptionalDuration(p.EjectionTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ejection time: %w", err)
+	}
+
+	return &upstream.PassiveHealthCheck{
+		ConsecutiveFailures: p.ConsecutiveFailures,
+		EjectionTime:        ejection,
+	}, nil
+}
+
+func (r *Retry) parse() (*upstream.RetryPolicy, error) {
+	backoff, err := parseOptionalDuration(r.Backoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry backoff: %w", err)
+	}
+
+	maxBackoff, err := parseOptionalDuration(r.MaxBackoff)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry max_backoff: %w", err)
+	}
+
+	on, err := upstream.ParseRetryOn(r.On)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstream.RetryPolicy{
+		MaxAttempts:  r.Attempts,
+		Backoff:      backoff,
+		MaxBackoff:   maxBackoff,
+		On:           on,
+		MaxBodyBytes: r.MaxBodyBytes,
+	}, nil
+}
+
+func (cb *CircuitBreaker) parse() (*upstream.CircuitBreaker, error) {
+	window, err := parseOptionalDuration(cb.Window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker window: %w", err)
+	}
+
+	slow, err := parseOptionalDuration(cb.SlowRequest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker slow_request: %w", err)
+	}
+
+	open, err := parseOptionalDuration(cb.OpenDuration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker open_duration: %w", err)
+	}
+
+	return &upstream.CircuitBreaker{
+		Window:           window,
+		MinRequests:      cb.MinRequests,
+		ErrorRate:        cb.ErrorRate,
+		SlowRequest:      slow,
+		SlowRate:         cb.SlowRate,
+		OpenDuration:     open,
+		HalfOpenRequests: cb.HalfOpenRequests,
+	}, nil
+}
+
+func (p *ConnectionPool) parse() (upstream.ConnectionPool, error) {
+	idle, err := parseOptionalDuration(p.IdleTimeout)
+	if err != nil {
+		return upstream.ConnectionPool{}, fmt.Errorf("invalid connection pool idle_timeout: %w", err)
+	}
+
+	keepAlive, err := parseOptionalDuration(p.KeepAlive)
+	if err != nil {
+		return upstream.ConnectionPool{}, fmt.Errorf("invalid connection pool keep_alive: %w", err)
+	}
+
+	headers, err := parseOptionalDuration(p.ResponseHeaderTimeout)
+	if err != nil {
+		return upstream.ConnectionPool{}, fmt.Errorf("invalid connection pool response_header_timeout: %w", err)
+	}
+
+	return upstream.ConnectionPool{
+		MaxIdlePerEndpoint:    p.MaxIdlePerEndpoint,
+		IdleTimeout:           idle,
+		KeepAlive:             keepAlive,
+		ResponseHeaderTimeout: headers,
+	}, nil
+}
+
+// parseOptionalDuration parses s, or returns zero if s is empty.
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(s)
+}
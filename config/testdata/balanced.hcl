@@ -0,0 +1,36 @@
+upstream "app" {
+  addrs    = ["tcp://127.0.0.1:8001", "tcp://127.0.0.1:8002", "tcp://127.0.0.1:8003"]
+  paths    = ["**"]
+  balancer = "least_request"
+  timeout  = "15s"
+
+  health_check {
+    path                = "/healthz"
+    interval            = "5s"
+    timeout             = "1s"
+    unhealthy_threshold = 2
+  }
+
+  passive_health_check {
+    consecutive_failures = 3
+    ejection_time        = "1m"
+  }
+
+  retry {
+    attempts = 4
+    backoff  = "10ms"
+    on       = "connection_errors"
+  }
+
+  circuit_breaker {
+    error_rate    = 0.25
+    slow_request  = "500ms"
+    open_duration = "10s"
+  }
+
+  connection_pool {
+    max_idle_per_endpoint   = 64
+    idle_timeout            = "2m"
+    response_header_timeout = "30s"
+  }
+}
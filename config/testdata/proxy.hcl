@@ -0,0 +1,4 @@
+upstream_headers = {
+  "Spiffe-Id"          = "{{ id }}"
+  "X-Caller-Namespace" = "{{ segment 1 }}"
+}
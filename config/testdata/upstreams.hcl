@@ -0,0 +1,11 @@
+upstream "admin" {
+  addr  = "unix:///run/admin.sock"
+  paths = ["/admin/**"]
+}
+
+upstream "reports" {
+  addr      = "https://127.0.0.1:9443"
+  paths     = ["/reports/**", "/exports/*"]
+  spiffe_id = "spiffe://example.org/reports"
+  http2     = true
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+// UpstreamTarget describes how to reach and verify one upstream.
+type UpstreamTarget struct {
+	// URLs are the addresses of the upstream's endpoints, with a tcp, tcp4,
+	// tcp6, https, or unix scheme. Either all or none of them are https.
+	URLs []*url.URL
+	// SPIFFEID or TrustDomain, if either is set, is the identity the upstream
+	// must present in its X509-SVID.
+	SPIFFEID    string
+	TrustDomain string
+	// CAFile is a PEM file of CAs to verify a non-SPIFFE https upstream.
+	CAFile string
+	// Timeout limits how long to wait to connect and for response headers.
+	// Zero means no limit.
+	Timeout time.Duration
+	// HTTP2 speaks HTTP/2 to the upstream, with h2c unless it uses TLS.
+	HTTP2 bool
+	// Balancer spreads requests across URLs.
+	Balancer upstream.Balancer
+	// HealthCheck and PassiveHealthCheck are nil unless enabled.
+	HealthCheck        *upstream.HealthCheck
+	PassiveHealthCheck *upstream.PassiveHealthCheck
+	// Retry is nil unless failed requests are retried.
+	Retry *upstream.RetryPolicy
+	// CircuitBreaker is nil unless enabled.
+	CircuitBreaker *upstream.CircuitBreaker
+	// ConnectionPool's zero values use the upstream package's defaults.
+	ConnectionPool upstream.ConnectionPool
+}
+
+// Addrs resolves the address of every endpoint.
+func (t *UpstreamTarget) Addrs() ([]net.Addr, error) {
+	if len(t.URLs) == 0 {
+		return nil, errors.New("an upstream address is required")
+	}
+
+	addrs := make([]net.Addr, 0, len(t.URLs))
+	for _, u := range t.URLs {
+		if (u.Scheme == "https") != t.TLS() {
+			return nil, errors.New("upstream addresses must either all or none be https")
+		}
+
+		addr, err := upstreamAddr(u)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// TLS reports whether the proxy connects to the upstream with TLS.
+func (t *UpstreamTarget) TLS() bool {
+	return len(t.URLs) > 0 && t.URLs[0].Scheme == "https"
+}
+
+// ServerName is the host name of the first endpoint. It's the default name
+// to verify and send during the TLS handshake, though each endpoint created
+// with upstream.WithEndpoint uses its own.
+func (t *UpstreamTarget) ServerName() string {
+	if len(t.URLs) == 0 {
+		return ""
+	}
+
+	return t.URLs[0].Hostname()
+}
+
+// Authorizer returns the authorizer for an upstream that presents an
+// X509-SVID, or nil if the upstream should be verified with Web PKI instead.
+func (t *UpstreamTarget) Authorizer() (tlsconfig.Authorizer, error) {
+	switch {
+	case t.SPIFFEID != "" && t.TrustDomain != "":
+		return nil, errors.New("only one of an upstream spiffe id and trust domain may be set")
+	case t.SPIFFEID != "":
+		id, err := spiffeid.FromString(t.SPIFFEID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream spiffe id: %w", err)
+		}
+
+		return tlsconfig.AuthorizeID(id), nil
+	case t.TrustDomain != "":
+		td, err := spiffeid.TrustDomainFromString(t.TrustDomain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream trust domain: %w", err)
+		}
+
+		return tlsconfig.AuthorizeMemberOf(td), nil
+	default:
+		return nil, nil //nolint:nilnil // no authorizer means Web PKI
+	}
+}
+
+// RootCAs returns the CA certificates in CAFile, or nil to use the system
+// roots.
+func (t *UpstreamTarget) RootCAs() (*x509.CertPool, error) {
+	if t.CAFile == "" {
+		return nil, nil //nolint:nilnil // nil means the system roots
+	}
+
+	// ignore gosec G304, this is on purpose
+	pemBytes, err := os.ReadFile(t.CAFile) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+	}
+
+	return pool, nil
+}
+
+func upstreamAddr(u *url.URL) (net.Addr, error) {
+	switch u.Scheme {
+	case "tcp":
+		return net.ResolveTCPAddr("tcp", u.Host)
+	case "tcp4":
+		return net.ResolveTCPAddr("tcp4", u.Host)
+	case "tcp6":
+		return net.ResolveTCPAddr("tcp6", u.Host)
+	case "https":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+
+		return net.ResolveTCPAddr("tcp", host)
+	case "unix":
+		return &net.UnixAddr{
+			Net:  "unix",
+			Name: u.Path,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %s", u.Scheme)
+	}
+}
@@ -1,25 +1,67 @@
 package healthhandler
 
 import (
+	"context"
+	"encoding/json"
 	"log/slog"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
-type Updater interface {
-	Update() <-chan struct{}
+const defaultCheckTimeout = time.Second
+
+// Checker reports whether one part of the proxy is healthy by returning nil.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to a Checker.
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+const (
+	statusOK       = "ok"
+	statusFailing  = "failing"
+	statusStarting = "starting"
+	statusDraining = "draining"
+)
+
+// Status is the JSON body of every probe's response.
+type Status struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckStatus `json:"checks,omitempty"`
+}
+
+// CheckStatus is the result of one check.
+type CheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type namedCheck struct {
+	name    string
+	checker Checker
 }
 
 type Health struct {
 	*http.ServeMux
-	sourceUpdater Updater
-	logger        *slog.Logger
+	logger       *slog.Logger
+	checks       []namedCheck
+	checkTimeout time.Duration
+	started      atomic.Bool
+	draining     atomic.Bool
 }
 
 var _ http.Handler = (*Health)(nil)
 
 func New(opts ...Option) *Health {
 	c := &config{
-		logger: slog.Default(),
+		logger:       slog.Default(),
+		checkTimeout: defaultCheckTimeout,
 	}
 	for _, opt := range opts {
 		opt.Apply(c)
@@ -27,9 +69,10 @@ func New(opts ...Option) *Health {
 
 	mux := http.NewServeMux()
 	h := &Health{
-		ServeMux:      mux,
-		logger:        c.logger,
-		sourceUpdater: c.updater,
+		ServeMux:     mux,
+		logger:       c.logger,
+		checks:       c.checks,
+		checkTimeout: c.checkTimeout,
 	}
 
 	mux.HandleFunc("/ready", h.serveReady)
@@ -39,21 +82,86 @@ func New(opts ...Option) *Health {
 	return h
 }
 
-func (*Health) serveReady(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// Started marks the initial loading as finished, so that /startup succeeds
+// and /ready starts running its checks.
+func (h *Health) Started() {
+	h.started.Store(true)
 }
 
-func (*Health) serveLive(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// Drain marks the proxy as shutting down, so that /ready fails and load
+// balancers stop sending it new requests. It can't be undone.
+func (h *Health) Drain() {
+	h.draining.Store(true)
 }
 
-func (*Health) serveStartup(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// serveReady succeeds once the proxy has started, every readiness check
+// passes, and it isn't shutting down.
+func (h *Health) serveReady(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case h.draining.Load():
+		h.write(w, r, http.StatusServiceUnavailable, Status{Status: statusDraining})
+
+		return
+	case !h.started.Load():
+		h.write(w, r, http.StatusServiceUnavailable, Status{Status: statusStarting})
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.checkTimeout)
+	defer cancel()
+
+	status := Status{
+		Status: statusOK,
+		Checks: make(map[string]CheckStatus, len(h.checks)),
+	}
+	for _, check := range h.checks {
+		result := CheckStatus{Status: statusOK}
+		if err := check.checker.Check(ctx); err != nil {
+			result = CheckStatus{Status: statusFailing, Error: err.Error()}
+			status.Status = statusFailing
+			h.logger.WarnContext(ctx, "readiness check failed", "check", check.name, "error", err)
+		}
+		status.Checks[check.name] = result
+	}
+
+	code := http.StatusOK
+	if status.Status != statusOK {
+		code = http.StatusServiceUnavailable
+	}
+	h.write(w, r, code, status)
+}
+
+// serveLive succeeds as long as the proxy can answer at all.
+func (h *Health) serveLive(w http.ResponseWriter, r *http.Request) {
+	h.write(w, r, http.StatusOK, Status{Status: statusOK})
+}
+
+// serveStartup succeeds once the initial loading has finished.
+func (h *Health) serveStartup(w http.ResponseWriter, r *http.Request) {
+	if !h.started.Load() {
+		h.write(w, r, http.StatusServiceUnavailable, Status{Status: statusStarting})
+
+		return
+	}
+
+	h.write(w, r, http.StatusOK, Status{Status: statusOK})
+}
+
+func (h *Health) write(w http.ResponseWriter, r *http.Request, code int, status Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger.DebugContext(r.Context(), "failed to write health response", "error", err)
+	}
 }
 
 type config struct {
-	logger  *slog.Logger
-	updater Updater
+	logger       *slog.Logger
+	checks       []namedCheck
+	checkTimeout time.Duration
 }
 
 type Option interface {
@@ -72,8 +180,19 @@ func WithLogger(l *slog.Logger) Option {
 	})
 }
 
-func WithUpdater(u Updater) Option {
+// WithReadinessCheck adds a check that must pass for /ready to succeed.
+// Checks run in the order they're added, and name identifies the check in
+// the response.
+func WithReadinessCheck(name string, c Checker) Option {
+	return optionFunc(func(cfg *config) {
+		cfg.checks = append(cfg.checks, namedCheck{name: name, checker: c})
+	})
+}
+
+// WithCheckTimeout limits how long all the readiness checks may take
+// together. The default is one second.
+func WithCheckTimeout(d time.Duration) Option {
 	return optionFunc(func(c *config) {
-		c.updater = u
+		c.checkTimeout = d
 	})
 }
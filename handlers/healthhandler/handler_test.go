@@ -0,0 +1,198 @@
+package healthhandler_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/healthhandler"
+)
+
+func probe(t *testing.T, h http.Handler, path string) (int, healthhandler.Status) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, http.NoBody))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var status healthhandler.Status
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+
+	return rec.Code, status
+}
+
+func passing() healthhandler.Checker {
+	return healthhandler.CheckerFunc(func(context.Context) error {
+		return nil
+	})
+}
+
+func failing(err error) healthhandler.Checker {
+	return healthhandler.CheckerFunc(func(context.Context) error {
+		return err
+	})
+}
+
+func TestHealth_Live(t *testing.T) {
+	h := healthhandler.New(healthhandler.WithReadinessCheck("policy", failing(errors.New("no policy loaded"))))
+
+	code, status := probe(t, h, "/live")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthhandler.Status{Status: "ok"}, status)
+}
+
+func TestHealth_Startup(t *testing.T) {
+	h := healthhandler.New()
+
+	code, status := probe(t, h, "/startup")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthhandler.Status{Status: "starting"}, status)
+
+	h.Started()
+
+	code, status = probe(t, h, "/startup")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthhandler.Status{Status: "ok"}, status)
+}
+
+func TestHealth_Ready(t *testing.T) {
+	tests := map[string]struct {
+		checks  []healthhandler.Option
+		started bool
+		drain   bool
+		code    int
+		status  healthhandler.Status
+	}{
+		"starting": {
+			checks: []healthhandler.Option{healthhandler.WithReadinessCheck("svid", passing())},
+			code:   http.StatusServiceUnavailable,
+			status: healthhandler.Status{Status: "starting"},
+		},
+		"ok": {
+			checks: []healthhandler.Option{
+				healthhandler.WithReadinessCheck("svid", passing()),
+				healthhandler.WithReadinessCheck("policy", passing()),
+			},
+			started: true,
+			code:    http.StatusOK,
+			status: healthhandler.Status{
+				Status: "ok",
+				Checks: map[string]healthhandler.CheckStatus{
+					"svid":   {Status: "ok"},
+					"policy": {Status: "ok"},
+				},
+			},
+		},
+		"failing": {
+			checks: []healthhandler.Option{
+				healthhandler.WithReadinessCheck("svid", passing()),
+				healthhandler.WithReadinessCheck("policy", failing(errors.New("policy watcher stopped"))),
+			},
+			started: true,
+			code:    http.StatusServiceUnavailable,
+			status: healthhandler.Status{
+				Status: "failing",
+				Checks: map[string]healthhandler.CheckStatus{
+					"svid":   {Status: "ok"},
+					"policy": {Status: "failing", Error: "policy watcher stopped"},
+				},
+			},
+		},
+		"draining": {
+			checks:  []healthhandler.Option{healthhandler.WithReadinessCheck("svid", passing())},
+			started: true,
+			drain:   true,
+			code:    http.StatusServiceUnavailable,
+			status:  healthhandler.Status{Status: "draining"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := healthhandler.New(tc.checks...)
+			if tc.started {
+				h.Started()
+			}
+			if tc.drain {
+				h.Drain()
+			}
+
+			code, status := probe(t, h, "/ready")
+			assert.Equal(t, tc.code, code)
+			assert.Equal(t, tc.status, status)
+		})
+	}
+}
+
+func TestHealth_ReadyCheckTimeout(t *testing.T) {
+	slow := healthhandler.CheckerFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+
+	h := healthhandler.New(
+		healthhandler.WithReadinessCheck("upstream:default", slow),
+		healthhandler.WithCheckTimeout(10*time.Millisecond),
+	)
+	h.Started()
+
+	code, status := probe(t, h, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "context deadline exceeded", status.Checks["upstream:default"].Error)
+}
+
+type mockSVIDSource func() (*x509svid.SVID, error)
+
+func (m mockSVIDSource) GetX509SVID() (*x509svid.SVID, error) {
+	return m()
+}
+
+func TestSVIDCheck(t *testing.T) {
+	svidExpiring := func(notAfter time.Time) mockSVIDSource {
+		return func() (*x509svid.SVID, error) {
+			return &x509svid.SVID{
+				Certificates: []*x509.Certificate{{NotAfter: notAfter}},
+			}, nil
+		}
+	}
+
+	tests := map[string]struct {
+		source mockSVIDSource
+		err    string
+	}{
+		"valid": {
+			source: svidExpiring(time.Now().Add(time.Hour)),
+		},
+		"expired": {
+			source: svidExpiring(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)),
+			err:    "X509-SVID expired at 2020-01-02T03:04:05Z",
+		},
+		"missing": {
+			source: func() (*x509svid.SVID, error) {
+				return nil, errors.New("no SVID received yet")
+			},
+			err: "no X509-SVID: no SVID received yet",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := healthhandler.SVIDCheck(tc.source).Check(context.Background())
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package healthhandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// SVIDCheck fails unless source has an X509-SVID that hasn't expired, which
+// the proxy needs to accept connections.
+func SVIDCheck(source x509svid.Source) Checker {
+	return CheckerFunc(func(context.Context) error {
+		svid, err := source.GetX509SVID()
+		if err != nil {
+			return fmt.Errorf("no X509-SVID: %w", err)
+		}
+		if len(svid.Certificates) == 0 {
+			return errors.New("no X509-SVID certificate")
+		}
+
+		if notAfter := svid.Certificates[0].NotAfter; !time.Now().Before(notAfter) {
+			return fmt.Errorf("X509-SVID expired at %s", notAfter.Format(time.RFC3339))
+		}
+
+		return nil
+	})
+}
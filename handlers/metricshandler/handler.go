@@ -18,16 +18,22 @@ type Metrics struct {
 	Logger     *slog.Logger
 }
 
+// New serves the metrics from the gatherer at /metrics, in the Prometheus
+// text format or, if the scraper asks for it, in OpenMetrics with exemplars.
 func New(opts ...Option) *Metrics {
-	c := &config{}
+	c := &config{
+		Gatherer: prometheus.DefaultGatherer,
+		Logger:   slog.Default(),
+	}
 	for _, o := range opts {
 		o.Apply(c)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.HandlerFor(c.Gatherer, promhttp.HandlerOpts{
-		Registry: c.Registerer,
-		ErrorLog: slog.NewLogLogger(c.Logger.Handler(), slog.LevelInfo),
+		Registry:          c.Registerer,
+		ErrorLog:          slog.NewLogLogger(c.Logger.Handler(), slog.LevelInfo),
+		EnableOpenMetrics: true,
 	}))
 
 	m := &Metrics{
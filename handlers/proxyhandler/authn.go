@@ -0,0 +1,112 @@
+package proxyhandler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
+)
+
+const bearerPrefix = "bearer "
+
+// authnError is returned when a caller presented credentials that could not
+// be used. It carries the status to respond with and a reason for metrics.
+type authnError struct {
+	status int
+	reason string
+	err    error
+}
+
+func (e *authnError) Error() string {
+	return fmt.Sprintf("%s: %v", e.reason, e.err)
+}
+
+func (e *authnError) Unwrap() error {
+	return e.err
+}
+
+type jwtAuth struct {
+	bundles   jwtbundle.Source
+	audiences []string
+}
+
+// authenticate returns who the caller is and how it was verified. An
+// X509-SVID from the TLS handshake takes precedence over a JWT-SVID in the
+// Authorization header. Callers that present neither get the zero ID and
+// spiffeidutil.AuthMethodNone, so that only public routes will authorize.
+func (p *Proxy) authenticate(r *http.Request) (identity, error) {
+	anonymous := identity{authMethod: spiffeidutil.AuthMethodNone}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		spID, err := x509svid.IDFromCert(cert)
+		if err != nil {
+			return anonymous, &authnError{
+				status: http.StatusBadRequest,
+				reason: "no_spiffeid",
+				err:    err,
+			}
+		}
+
+		return identity{
+			id:         spID,
+			authMethod: spiffeidutil.AuthMethodX509,
+			cert:       cert,
+			expires:    cert.NotAfter,
+		}, nil
+	}
+
+	token, ok := bearerToken(r)
+	if !ok || p.jwt == nil {
+		return anonymous, nil
+	}
+
+	svid, err := jwtsvid.ParseAndValidate(token, p.jwt.bundles, p.jwt.audiences)
+	if err != nil {
+		return anonymous, &authnError{
+			status: http.StatusUnauthorized,
+			reason: "invalid_jwtsvid",
+			err:    err,
+		}
+	}
+
+	// The token was meant for the proxy. Don't hand it on to the upstream,
+	// which could replay it elsewhere.
+	r.Header.Del("Authorization")
+
+	return identity{
+		id:         svid.ID,
+		authMethod: spiffeidutil.AuthMethodJWT,
+		expires:    svid.Expiry,
+	}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < len(bearerPrefix) || !strings.EqualFold(h[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+
+	token := strings.TrimSpace(h[len(bearerPrefix):])
+
+	return token, token != ""
+}
+
+func asAuthnError(err error) *authnError {
+	var ae *authnError
+	if errors.As(err, &ae) {
+		return ae
+	}
+
+	return &authnError{
+		status: http.StatusBadRequest,
+		reason: "unknown",
+		err:    err,
+	}
+}
@@ -0,0 +1,227 @@
+package proxyhandler_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
+)
+
+func TestProxy_NoSVID_Public(t *testing.T) {
+	var authz mockAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) error {
+		if spid.IsZero() && method == http.MethodGet && path == "/healthz" {
+			return nil
+		}
+
+		return errors.New("not public")
+	}
+
+	var upstream mockUpstream = func(r *http.Request) (*http.Response, error) {
+		assert.Empty(t, r.Header.Get("Spiffe-Id"))
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}
+
+	srv, _ := startTestProxy(t,
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(upstream),
+	)
+
+	client := newAnonymousTestClient(t)
+
+	req, _ := http.NewRequestWithContext(
+		context.Background(),
+		http.MethodGet,
+		srv.URL+"/healthz",
+		http.NoBody,
+	)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxy_NoSVID_Unauthenticated(t *testing.T) {
+	var authz mockAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) error {
+		return errors.New("not public")
+	}
+
+	var upstream mockUpstream = func(r *http.Request) (*http.Response, error) {
+		t.Fatalf("this should never be called")
+		return nil, nil //nolint:nilnil,nlreturn
+	}
+
+	srv, _ := startTestProxy(t,
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(upstream),
+	)
+
+	client := newAnonymousTestClient(t)
+
+	req, _ := http.NewRequestWithContext(
+		context.Background(),
+		http.MethodGet,
+		srv.URL+"/my/path",
+		http.NoBody,
+	)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestProxy_JWTSVID(t *testing.T) {
+	var authz mockAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) error {
+		if spid.String() == "spiffe://example.org/jwt-workload" &&
+			spiffeidutil.AuthMethodFromContext(ctx) == spiffeidutil.AuthMethodJWT {
+			return nil
+		}
+
+		return errors.New("bad ID")
+	}
+
+	var upstream mockUpstream = func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "spiffe://example.org/jwt-workload", r.Header.Get("Spiffe-Id"))
+		assert.Empty(t, r.Header.Get("Authorization"))
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("it worked")),
+		}, nil
+	}
+
+	srv, _ := startTestProxy(t,
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(upstream),
+		proxyhandler.WithJWTAuth(testJWTBundle(t), "spiffe://example.org/server"),
+	)
+
+	client := newAnonymousTestClient(t)
+
+	t.Run("valid token", func(t *testing.T) {
+		token := newTestJWTSVID(t, "spiffe://example.org/jwt-workload", "spiffe://example.org/server")
+		req, _ := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodGet,
+			srv.URL+"/my/path",
+			http.NoBody,
+		)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		token := newTestJWTSVID(t, "spiffe://example.org/jwt-workload", "spiffe://example.org/other")
+		req, _ := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodGet,
+			srv.URL+"/my/path",
+			http.NoBody,
+		)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("garbage token", func(t *testing.T) {
+		req, _ := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodGet,
+			srv.URL+"/my/path",
+			http.NoBody,
+		)
+		req.Header.Set("Authorization", "Bearer not-a-jwt")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+}
+
+const testJWTKeyID = "test-key"
+
+func testJWTBundle(t *testing.T) *jwtbundle.Bundle {
+	t.Helper()
+
+	key := testJWTKey(t)
+
+	return jwtbundle.FromJWTAuthorities(
+		spiffeid.RequireTrustDomainFromString("example.org"),
+		map[string]crypto.PublicKey{testJWTKeyID: key.Public()},
+	)
+}
+
+func testJWTKey(t *testing.T) crypto.Signer {
+	t.Helper()
+
+	block, _ := pem.Decode(workloadKey)
+	require.NotNil(t, block)
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	require.NoError(t, err)
+
+	signer, ok := key.(crypto.Signer)
+	require.True(t, ok)
+
+	return signer
+}
+
+func newTestJWTSVID(t *testing.T, subject string, audience ...string) string {
+	t.Helper()
+
+	return newTestJWTSVIDWithTTL(t, time.Minute, subject, audience...)
+}
+
+func newTestJWTSVIDWithTTL(t *testing.T, ttl time.Duration, subject string, audience ...string) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{
+			Algorithm: jose.RS256,
+			Key: jose.JSONWebKey{
+				Key:   testJWTKey(t),
+				KeyID: testJWTKeyID,
+			},
+		},
+		new(jose.SignerOptions).WithType("JWT"),
+	)
+	require.NoError(t, err)
+
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Subject:  subject,
+		Audience: audience,
+		Expiry:   jwt.NewNumericDate(time.Now().Add(ttl)),
+	}).Serialize()
+	require.NoError(t, err)
+
+	return token
+}
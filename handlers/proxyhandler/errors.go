@@ -0,0 +1,39 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+// statusClientClosedRequest is the nginx convention for a request whose
+// client went away before the response was ready. It's only logged; there's
+// no one left to write it to.
+const statusClientClosedRequest = 499
+
+// classifyUpstreamError maps an error from the upstream to the status to
+// answer with and a reason for logs and metrics. ctx is the inbound
+// request's context.
+func classifyUpstreamError(ctx context.Context, err error) (int, string) {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return statusClientClosedRequest, "client_canceled"
+	case errors.Is(err, upstream.ErrNoHealthyEndpoints):
+		return http.StatusServiceUnavailable, "no_healthy_endpoints"
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return http.StatusBadGateway, "connection_reset"
+	default:
+		return http.StatusBadGateway, "upstream_error"
+	}
+}
@@ -0,0 +1,177 @@
+package proxyhandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// viaPseudonym identifies the proxy in Via headers.
+const viaPseudonym = "spiffe-authz-proxy"
+
+// hopByHopHeaders only apply to a single connection, so a proxy must not
+// forward them (RFC 9110, section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes the hop-by-hop headers from h, including any that
+// are named in its Connection header.
+func removeHopByHop(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+func isTrailersToken(value string) bool {
+	return slices.ContainsFunc(strings.Split(value, ","), func(token string) bool {
+		return strings.EqualFold(strings.TrimSpace(token), "trailers")
+	})
+}
+
+// addVia records the proxy in the Via header of a message received with
+// HTTP version major.minor.
+func addVia(h http.Header, major, minor int) {
+	version := "2"
+	if major < 2 {
+		version = fmt.Sprintf("%d.%d", major, minor)
+	}
+	h.Add("Via", version+" "+viaPseudonym)
+}
+
+// ForwardedMode controls what the proxy does with the Forwarded,
+// X-Forwarded-For, X-Forwarded-Host, and X-Forwarded-Proto headers. The zero
+// value leaves any inbound headers untouched and adds nothing.
+type ForwardedMode string
+
+const (
+	ForwardedOff ForwardedMode = ""
+	// ForwardedSanitize removes any inbound headers and doesn't add any.
+	ForwardedSanitize ForwardedMode = "sanitize"
+	// ForwardedAppend keeps any inbound headers and appends the caller's
+	// address, for when the proxy is behind a trusted load balancer.
+	ForwardedAppend ForwardedMode = "append"
+	// ForwardedReplace removes any inbound headers and sets them from the
+	// connection to the proxy.
+	ForwardedReplace ForwardedMode = "replace"
+)
+
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+// ParseForwardedMode validates a mode from configuration.
+func ParseForwardedMode(s string) (ForwardedMode, error) {
+	switch m := ForwardedMode(strings.ToLower(s)); m {
+	case ForwardedOff, ForwardedSanitize, ForwardedAppend, ForwardedReplace:
+		return m, nil
+	default:
+		return ForwardedOff, fmt.Errorf(
+			"unsupported forwarded mode %q, must be one of [%s, %s, %s]",
+			s, ForwardedSanitize, ForwardedAppend, ForwardedReplace,
+		)
+	}
+}
+
+// apply sets the forwarded headers on h, the upstream request's headers,
+// from r, the inbound request.
+func (m ForwardedMode) apply(h http.Header, r *http.Request) {
+	switch m {
+	case ForwardedOff:
+		return
+	case ForwardedSanitize:
+		for _, name := range forwardedHeaders {
+			h.Del(name)
+		}
+
+		return
+	case ForwardedReplace:
+		for _, name := range forwardedHeaders {
+			h.Del(name)
+		}
+	case ForwardedAppend:
+	}
+
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client = host
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	appendValue(h, "X-Forwarded-For", client)
+	// These describe the original request, so an earlier proxy's values win.
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+
+	node := client
+	if strings.Contains(node, ":") {
+		node = "[" + node + "]"
+	}
+	appendValue(h, "Forwarded", fmt.Sprintf(
+		"for=%s;host=%s;proto=%s",
+		forwardedValue(node), forwardedValue(r.Host), proto,
+	))
+}
+
+// appendValue adds value to the end of h's comma-separated list of name.
+func appendValue(h http.Header, name, value string) {
+	if prev := strings.Join(h.Values(name), ", "); prev != "" {
+		value = prev + ", " + value
+	}
+	h.Set(name, value)
+}
+
+// forwardedValue returns s as a token, or as a quoted string if it isn't
+// one (RFC 7239, section 4).
+func forwardedValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+
+	for _, c := range s {
+		if !isTokenChar(c) {
+			return strconv.Quote(s)
+		}
+	}
+
+	return s
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	default:
+		return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+	}
+}
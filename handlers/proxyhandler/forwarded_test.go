@@ -0,0 +1,92 @@
+package proxyhandler_test
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+)
+
+func TestProxy_Forwarded(t *testing.T) {
+	inbound := http.Header{
+		"Forwarded":         {"for=192.0.2.1;host=app.example.org;proto=https"},
+		"X-Forwarded-For":   {"192.0.2.1"},
+		"X-Forwarded-Host":  {"app.example.org"},
+		"X-Forwarded-Proto": {"https"},
+	}
+
+	tests := map[proxyhandler.ForwardedMode]func(host string) http.Header{
+		proxyhandler.ForwardedOff: func(string) http.Header {
+			return inbound
+		},
+		proxyhandler.ForwardedSanitize: func(string) http.Header {
+			return http.Header{}
+		},
+		proxyhandler.ForwardedReplace: func(host string) http.Header {
+			return http.Header{
+				"Forwarded":         {`for=127.0.0.1;host="` + host + `";proto=https`},
+				"X-Forwarded-For":   {"127.0.0.1"},
+				"X-Forwarded-Host":  {host},
+				"X-Forwarded-Proto": {"https"},
+			}
+		},
+		proxyhandler.ForwardedAppend: func(host string) http.Header {
+			return http.Header{
+				"Forwarded": {
+					`for=192.0.2.1;host=app.example.org;proto=https, for=127.0.0.1;host="` + host + `";proto=https`,
+				},
+				"X-Forwarded-For":   {"192.0.2.1, 127.0.0.1"},
+				"X-Forwarded-Host":  {"app.example.org"},
+				"X-Forwarded-Proto": {"https"},
+			}
+		},
+	}
+
+	for mode, expected := range tests {
+		t.Run(string(mode), func(t *testing.T) {
+			var host string
+			var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+				want := expected(host)
+				for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+					assert.Equal(t, want.Values(name), r.Header.Values(name), name)
+				}
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader("ok")),
+				}, nil
+			}
+
+			srv, client := startTestProxy(t,
+				proxyhandler.WithAuthorizer(allowAll{}),
+				proxyhandler.WithUpstream(up),
+				proxyhandler.WithForwarded(mode),
+			)
+			host = srv.Listener.Addr().String()
+
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/my/path", http.NoBody)
+			maps.Copy(req.Header, inbound)
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestParseForwardedMode(t *testing.T) {
+	mode, err := proxyhandler.ParseForwardedMode("Append")
+	require.NoError(t, err)
+	assert.Equal(t, proxyhandler.ForwardedAppend, mode)
+
+	_, err = proxyhandler.ParseForwardedMode("trust-everyone")
+	require.Error(t, err)
+}
@@ -0,0 +1,72 @@
+package proxyhandler
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes, from
+// https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcUnknown           = 2
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// isGRPC reports whether contentType is a gRPC message, like
+// "application/grpc" or "application/grpc+proto".
+func isGRPC(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// grpcCode returns the gRPC status code for an error the proxy would
+// otherwise answer with the HTTP status.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusRequestEntityTooLarge:
+		return grpcResourceExhausted
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusInternalServerError:
+		return grpcInternal
+	default:
+		return grpcUnknown
+	}
+}
+
+// writeError answers r with status. gRPC clients only look at the
+// grpc-status, so gRPC requests get a trailers-only response with the
+// equivalent code instead.
+func writeError(w http.ResponseWriter, r *http.Request, status int) {
+	if !isGRPC(r.Header.Get("Content-Type")) {
+		w.WriteHeader(status)
+
+		return
+	}
+
+	// Without a body, the headers are sent as the trailers, too.
+	header := w.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(grpcCode(status)))
+	if msg := http.StatusText(status); msg != "" {
+		header.Set("Grpc-Message", msg)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,124 @@
+package proxyhandler_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+func newGRPCRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, strings.NewReader("message"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("Te", "trailers")
+
+	return req
+}
+
+func TestProxy_GRPC(t *testing.T) {
+	var authz mockAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) error {
+		if method == http.MethodPost && path == "/payments.v1.Ledger/GetBalance" {
+			return nil
+		}
+
+		return errors.New("nope")
+	}
+
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "application/grpc+proto", r.Header.Get("Content-Type"))
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/grpc+proto"}},
+			Trailer:    http.Header{"Grpc-Status": {"0"}},
+			Body:       io.NopCloser(strings.NewReader("response")),
+		}, nil
+	}
+
+	proxy := proxyhandler.New(
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(up),
+	)
+
+	srv, client := newTestClientServer(t, proxy)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+
+	t.Run("allowed", func(t *testing.T) {
+		resp, err := client.Do(newGRPCRequest(t, srv.URL+"/payments.v1.Ledger/GetBalance"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, 2, resp.ProtoMajor)
+		assert.Equal(t, "response", string(body))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		resp, err := client.Do(newGRPCRequest(t, srv.URL+"/payments.v1.Ledger/Transfer"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "7", resp.Header.Get("Grpc-Status"))
+		assert.Equal(t, "Forbidden", resp.Header.Get("Grpc-Message"))
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		resp, err := newAnonymousTestClient(t).Do(newGRPCRequest(t, srv.URL+"/payments.v1.Ledger/Transfer"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "16", resp.Header.Get("Grpc-Status"))
+	})
+
+	t.Run("not gRPC", func(t *testing.T) {
+		req := newGRPCRequest(t, srv.URL+"/payments.v1.Ledger/Transfer")
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Grpc-Status"))
+	})
+}
+
+func TestProxy_GRPCUpstreamError(t *testing.T) {
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		return nil, upstream.ErrNoHealthyEndpoints
+	}
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+	)
+
+	resp, err := client.Do(newGRPCRequest(t, srv.URL+"/payments.v1.Ledger/GetBalance"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "14", resp.Header.Get("Grpc-Status"))
+	assert.Equal(t, "Service Unavailable", resp.Header.Get("Grpc-Message"))
+}
@@ -0,0 +1,149 @@
+package proxyhandler
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
+)
+
+// HeaderTemplates set headers on upstream requests from the caller's
+// verified identity. Each value is a text/template with these functions:
+//
+//	id           the full SPIFFE ID
+//	trustDomain  the trust domain name
+//	path         the path of the SPIFFE ID
+//	segment N    the Nth segment of the path, counting from 0, so
+//	             `segment 1` of /ns/x/sa/y is "x"
+//	authMethod   how the caller authenticated, "x509" or "jwt"
+//	serial       the X509-SVID serial number in hexadecimal
+//	notAfter     the X509-SVID expiry in RFC 3339 format
+//
+// The certificate functions return an empty string for callers that used a
+// JWT-SVID. Headers whose value is empty are not set.
+type HeaderTemplates struct {
+	templates []headerTemplate
+}
+
+type headerTemplate struct {
+	name string
+	tmpl *template.Template
+}
+
+// DefaultHeaderTemplates sets only SPIFFEIDHeader to the caller's SPIFFE ID.
+func DefaultHeaderTemplates() *HeaderTemplates {
+	h, _ := ParseHeaderTemplates(map[string]string{SPIFFEIDHeader: "{{ id }}"})
+
+	return h
+}
+
+// ParseHeaderTemplates parses a map of header names to templates.
+func ParseHeaderTemplates(headers map[string]string) (*HeaderTemplates, error) {
+	h := &HeaderTemplates{
+		templates: make([]headerTemplate, 0, len(headers)),
+	}
+
+	funcs := identityFuncs(identity{})
+	for name, text := range headers {
+		tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %w", name, err)
+		}
+
+		h.templates = append(h.templates, headerTemplate{
+			name: http.CanonicalHeaderKey(name),
+			tmpl: tmpl,
+		})
+	}
+
+	slices.SortFunc(h.templates, func(a, b headerTemplate) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	return h, nil
+}
+
+// Names returns the headers that the templates set.
+func (h *HeaderTemplates) Names() []string {
+	names := make([]string, 0, len(h.templates))
+	for _, t := range h.templates {
+		names = append(names, t.name)
+	}
+
+	return names
+}
+
+func (h *HeaderTemplates) apply(dst http.Header, id identity) error {
+	funcs := identityFuncs(id)
+	for _, t := range h.templates {
+		tmpl, err := t.tmpl.Clone()
+		if err != nil {
+			return err
+		}
+
+		var sb strings.Builder
+		if err := tmpl.Funcs(funcs).Execute(&sb, nil); err != nil {
+			return fmt.Errorf("could not render header %s: %w", t.name, err)
+		}
+
+		if v := sb.String(); v != "" {
+			dst.Set(t.name, v)
+		}
+	}
+
+	return nil
+}
+
+// identity is what the caller has been verified as.
+type identity struct {
+	id         spiffeid.ID
+	authMethod spiffeidutil.AuthMethod
+	cert       *x509.Certificate
+	// expires is when the SVID the caller presented stops being valid, or
+	// zero if it didn't present one.
+	expires time.Time
+}
+
+func identityFuncs(id identity) template.FuncMap {
+	return template.FuncMap{
+		"id":          id.id.String,
+		"trustDomain": id.id.TrustDomain().Name,
+		"path":        id.id.Path,
+		"segment":     id.segment,
+		"authMethod":  func() string { return string(id.authMethod) },
+		"serial":      id.serial,
+		"notAfter":    id.notAfter,
+	}
+}
+
+func (i identity) segment(n int) string {
+	segments := strings.Split(strings.TrimPrefix(i.id.Path(), "/"), "/")
+	if n < 0 || n >= len(segments) {
+		return ""
+	}
+
+	return segments[n]
+}
+
+func (i identity) serial() string {
+	if i.cert == nil || i.cert.SerialNumber == nil {
+		return ""
+	}
+
+	return i.cert.SerialNumber.Text(16)
+}
+
+func (i identity) notAfter() string {
+	if i.cert == nil {
+		return ""
+	}
+
+	return i.cert.NotAfter.UTC().Format(time.RFC3339)
+}
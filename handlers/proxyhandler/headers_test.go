@@ -0,0 +1,127 @@
+package proxyhandler_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil/assertion"
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+func TestProxy_HeaderTemplates(t *testing.T) {
+	leaf, err := x509svid.Parse(workloadSVID, workloadKey)
+	require.NoError(t, err)
+
+	var upstream mockUpstream = func(r *http.Request) (*http.Response, error) {
+		assert.Empty(t, r.Header.Values("Spiffe-Id"), "the default header is replaced")
+		assert.Equal(t, "spiffe://example.org/workload", r.Header.Get("X-Caller-Id"))
+		assert.Equal(t, "example.org", r.Header.Get("X-Caller-Trust-Domain"))
+		assert.Equal(t, "workload", r.Header.Get("X-Caller-Name"))
+		assert.Equal(t, "x509", r.Header.Get("X-Caller-Auth"))
+		assert.Equal(t, leaf.Certificates[0].SerialNumber.Text(16), r.Header.Get("X-Caller-Serial"))
+		assert.Equal(t, leaf.Certificates[0].NotAfter.UTC().Format(time.RFC3339), r.Header.Get("X-Caller-Expiry"))
+		assert.Empty(t, r.Header.Values("X-Caller-Namespace"), "empty values are not set, and forged values are stripped")
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}
+
+	headers, err := proxyhandler.ParseHeaderTemplates(map[string]string{
+		"X-Caller-Id":           "{{ id }}",
+		"X-Caller-Trust-Domain": "{{ trustDomain }}",
+		"X-Caller-Name":         "{{ segment 0 }}",
+		"X-Caller-Namespace":    "{{ segment 1 }}",
+		"X-Caller-Auth":         "{{ authMethod }}",
+		"X-Caller-Serial":       "{{ serial }}",
+		"X-Caller-Expiry":       "{{ notAfter }}",
+	})
+	require.NoError(t, err)
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(upstream),
+		proxyhandler.WithHeaderTemplates(headers),
+	)
+
+	req, _ := http.NewRequestWithContext(
+		context.Background(),
+		http.MethodGet,
+		srv.URL+"/my/path",
+		http.NoBody,
+	)
+	req.Header.Set("X-Caller-Namespace", "kube-system")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxy_IdentityAssertion(t *testing.T) {
+	var signer mockSigner = func(caller spiffeid.ID, audience, method, path string) (string, error) {
+		return strings.Join([]string{caller.String(), audience, method, path}, " "), nil
+	}
+
+	echoAssertion := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Join(r.Header.Values(assertion.Header), ","))
+	})
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(newTestUpstream(t, echoAssertion, upstream.WithName("default"))),
+		proxyhandler.WithUpstreamRoute(newTestUpstream(t, echoAssertion, upstream.WithName("api")), "/api/*"),
+		proxyhandler.WithAssertionSigner(signer),
+	)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/my/path", "spiffe://example.org/workload default PUT /my/path"},
+		{"/api/users", "spiffe://example.org/workload api PUT /api/users"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(
+				context.Background(),
+				http.MethodPut,
+				srv.URL+tt.path,
+				http.NoBody,
+			)
+			req.Header.Set(assertion.Header, "forged")
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tt.expected, string(body))
+		})
+	}
+}
+
+func TestParseHeaderTemplates_Invalid(t *testing.T) {
+	_, err := proxyhandler.ParseHeaderTemplates(map[string]string{
+		"X-Broken": "{{ segment }",
+	})
+	require.Error(t, err)
+
+	_, err = proxyhandler.ParseHeaderTemplates(map[string]string{
+		"X-Unknown": "{{ nope }}",
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,134 @@
+package proxyhandler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+
+	"jsocol.io/spiffe-authz-proxy/authorizer"
+)
+
+// routeAuthorizer is implemented by authorizers that can also return the
+// route that allowed a request, like *authorizer.MemoryAuthorizer.
+type routeAuthorizer interface {
+	AuthorizeRoute(ctx context.Context, spid spiffeid.ID, method, path string) (authorizer.Route, error)
+}
+
+// authorize checks the request with the authorizer. The route is only
+// returned if the authorizer is a routeAuthorizer, and is otherwise empty.
+func (p *Proxy) authorize(ctx context.Context, spid spiffeid.ID, method, path string) (authorizer.Route, error) {
+	if ra, ok := p.authz.(routeAuthorizer); ok {
+		return ra.AuthorizeRoute(ctx, spid, method, path)
+	}
+
+	return authorizer.Route{}, p.authz.Authorize(ctx, spid, method, path)
+}
+
+// requestLimits tracks the write deadline of one request, and whether
+// reading its body failed, so that errors caused by limits can be told apart
+// from others.
+type requestLimits struct {
+	rc            *http.ResponseController
+	writeDeadline time.Time
+
+	bodyTooLarge atomic.Bool
+	timedOut     atomic.Bool
+}
+
+// bodyLimit is the largest request body allowed, and the rule it comes from.
+type bodyLimit struct {
+	bytes int64
+	rule  string
+}
+
+// defaultBodyLimitRule names the proxy-wide limit in metrics.
+const defaultBodyLimitRule = "default"
+
+// bodyLimit returns the limit set by route, or the proxy's limit if route
+// doesn't set one.
+func (p *Proxy) bodyLimit(route authorizer.Route) bodyLimit {
+	if route.MaxBodyBytes > 0 {
+		return bodyLimit{bytes: route.MaxBodyBytes, rule: route.Pattern}
+	}
+
+	return bodyLimit{bytes: p.maxBodyBytes, rule: defaultBodyLimitRule}
+}
+
+// exceededBy reports whether a declared Content-Length is over the limit.
+// Bodies of unknown length are only checked as they're read.
+func (b bodyLimit) exceededBy(contentLength int64) bool {
+	return b.bytes > 0 && contentLength > b.bytes
+}
+
+// applyLimits replaces the server's read and write deadlines for r with the
+// timeouts of route, if it has any, and limits r.Body to maxBody. r.Body is
+// wrapped to notice when reading it times out or goes over the limit.
+func applyLimits(w http.ResponseWriter, r *http.Request, route authorizer.Route, maxBody bodyLimit) *requestLimits {
+	now := time.Now()
+	l := &requestLimits{rc: http.NewResponseController(w)}
+
+	// The server's write deadline isn't visible to handlers, so it's set
+	// again from now to know when it passes. Writers that don't support
+	// deadlines, like in tests, return http.ErrNotSupported, and there's
+	// nothing else to do.
+	writeTimeout := route.WriteTimeout
+	if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok && writeTimeout == 0 {
+		writeTimeout = srv.WriteTimeout
+	}
+	if writeTimeout > 0 && l.rc.SetWriteDeadline(now.Add(writeTimeout)) == nil {
+		l.writeDeadline = now.Add(writeTimeout)
+	}
+
+	// Once the body has been read, the server clears the read deadline
+	// itself and watches the connection for the caller going away, so a
+	// deadline is only set while there's still a body to read.
+	if r.Body == nil || r.Body == http.NoBody {
+		return l
+	}
+
+	if route.ReadTimeout > 0 {
+		_ = l.rc.SetReadDeadline(now.Add(route.ReadTimeout))
+	}
+	if maxBody.bytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody.bytes)
+	}
+	r.Body = &limitedBody{ReadCloser: r.Body, limits: l}
+
+	return l
+}
+
+// readTimedOut reports whether reading the request body failed because of
+// the read deadline.
+func (l *requestLimits) readTimedOut() bool {
+	return l.timedOut.Load()
+}
+
+// writeTimedOut reports whether the write deadline has passed.
+func (l *requestLimits) writeTimedOut() bool {
+	return !l.writeDeadline.IsZero() && !time.Now().Before(l.writeDeadline)
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	limits *requestLimits
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		b.limits.bodyTooLarge.Store(true)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		b.limits.timedOut.Store(true)
+	}
+
+	return n, err
+}
@@ -0,0 +1,240 @@
+package proxyhandler_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/authorizer"
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+)
+
+// newEchoUpstream returns an upstream that responds with the request body.
+func newEchoUpstream() mockUpstream {
+	return func(r *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}, nil
+	}
+}
+
+func TestProxy_RouteReadTimeout(t *testing.T) {
+	tests := map[string]struct {
+		route  time.Duration
+		server time.Duration
+	}{
+		"route":  {route: 100 * time.Millisecond, server: time.Minute},
+		"server": {server: 100 * time.Millisecond},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var authz mockRouteAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) (authorizer.Route, error) {
+				return authorizer.Route{ReadTimeout: tc.route}, nil
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			proxy := proxyhandler.New(
+				proxyhandler.WithAuthorizer(authz),
+				proxyhandler.WithUpstream(newEchoUpstream()),
+				proxyhandler.WithMetrics(reg),
+			)
+
+			srv, client := newTestClientServer(t, proxy)
+			srv.Config.ReadTimeout = tc.server
+			srv.StartTLS()
+			defer srv.Close()
+
+			// The body is never finished, so reading it has to time out.
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			go func() { _, _ = io.WriteString(pw, "partial") }()
+
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/upload", pr)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+
+			err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_limit_exceeded_count A counter of requests that took longer than the read or write timeout, by which one.
+# TYPE proxy_limit_exceeded_count counter
+proxy_limit_exceeded_count{limit="read_timeout"} 1
+`), "proxy_limit_exceeded_count")
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestProxy_RouteReadTimeoutOverridesServer(t *testing.T) {
+	var authz mockRouteAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) (authorizer.Route, error) {
+		return authorizer.Route{ReadTimeout: 5 * time.Second}, nil
+	}
+
+	proxy := proxyhandler.New(
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(newEchoUpstream()),
+	)
+
+	srv, client := newTestClientServer(t, proxy)
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.StartTLS()
+	defer srv.Close()
+
+	// The upload takes longer than the server's ReadTimeout.
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = io.WriteString(pw, "slow ")
+		time.Sleep(300 * time.Millisecond)
+		_, _ = io.WriteString(pw, "upload")
+		_ = pw.Close()
+	}()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/upload", pr)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "slow upload", string(body))
+}
+
+func TestProxy_RouteWriteTimeout(t *testing.T) {
+	var authz mockRouteAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) (authorizer.Route, error) {
+		return authorizer.Route{WriteTimeout: 100 * time.Millisecond}, nil
+	}
+
+	up, pw, _ := newStreamingUpstream(http.Header{"Content-Type": {"text/event-stream"}}, nil)
+	reg := prometheus.NewPedanticRegistry()
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(up),
+		proxyhandler.WithMetrics(reg),
+	)
+	defer pw.Close()
+
+	resp, err := client.Get(srv.URL + "/events")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	// The write fails once the copy reads it, or the pipe is closed.
+	_, _ = io.WriteString(pw, "data: late\n")
+
+	_, err = io.ReadAll(resp.Body)
+	require.Error(t, err)
+
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_limit_exceeded_count A counter of requests that took longer than the read or write timeout, by which one.
+# TYPE proxy_limit_exceeded_count counter
+proxy_limit_exceeded_count{limit="write_timeout"} 1
+`), "proxy_limit_exceeded_count")
+		assert.NoError(c, err)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestProxy_MaxBodyBytes(t *testing.T) {
+	var authz mockRouteAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) (authorizer.Route, error) {
+		if strings.HasPrefix(path, "/upload/") {
+			return authorizer.Route{Pattern: "/upload/**", MaxBodyBytes: 16}, nil
+		}
+
+		return authorizer.Route{Pattern: "/**"}, nil
+	}
+
+	tests := map[string]struct {
+		path          string
+		body          string
+		unknownLength bool
+		status        int
+	}{
+		"under the default": {
+			path:   "/api",
+			body:   "small",
+			status: http.StatusOK,
+		},
+		"over the default": {
+			path:   "/api",
+			body:   "much too large",
+			status: http.StatusRequestEntityTooLarge,
+		},
+		"over the default without a length": {
+			path:          "/api",
+			body:          "much too large",
+			unknownLength: true,
+			status:        http.StatusRequestEntityTooLarge,
+		},
+		"under the route's limit": {
+			path:   "/upload/file",
+			body:   "much too large",
+			status: http.StatusOK,
+		},
+		"over the route's limit": {
+			path:   "/upload/file",
+			body:   "larger than sixteen bytes",
+			status: http.StatusRequestEntityTooLarge,
+		},
+		"over the route's limit without a length": {
+			path:          "/upload/file",
+			body:          "larger than sixteen bytes",
+			unknownLength: true,
+			status:        http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	proxy := proxyhandler.New(
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(newEchoUpstream()),
+		proxyhandler.WithMaxBodyBytes(8),
+		proxyhandler.WithMetrics(reg),
+	)
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			if tc.unknownLength {
+				req.ContentLength = -1
+			}
+
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.status, rec.Code)
+			if tc.status == http.StatusOK {
+				assert.Equal(t, tc.body, rec.Body.String())
+			}
+		})
+	}
+
+	err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_body_too_large_count A counter of requests rejected because their body was over the limit, by the rule that set it.
+# TYPE proxy_body_too_large_count counter
+proxy_body_too_large_count{rule="/upload/**"} 2
+proxy_body_too_large_count{rule="default"} 2
+`), "proxy_body_too_large_count")
+	require.NoError(t, err)
+}
@@ -2,37 +2,74 @@ package proxyhandler
 
 import (
 	"context"
-	"io"
+	"crypto/x509"
 	"log/slog"
 	"maps"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
-	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
 
+	"jsocol.io/spiffe-authz-proxy/authorizer"
 	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil/assertion"
 )
 
 type proxyAuthorizer interface {
 	Authorize(ctx context.Context, spid spiffeid.ID, method, path string) error
 }
 
+type denier interface {
+	CheckDenied(spid spiffeid.ID, cert *x509.Certificate) error
+}
+
+type assertionSigner interface {
+	Sign(caller spiffeid.ID, audience, method, path string) (string, error)
+}
+
 type upstreamer interface {
 	Proxy(*http.Request) (*http.Response, error)
 }
 
+// namedUpstream is implemented by upstreams with a name, which signed
+// assertions use as their audience.
+type namedUpstream interface {
+	Name() string
+}
+
 type Proxy struct {
 	logger   *slog.Logger
 	authz    proxyAuthorizer
 	upstream upstreamer
+	routes   []upstreamRoute
+	jwt      *jwtAuth
+	denyList denier
+	stripped headerSet
+	xfcc     *xfccConfig
+	headers  *HeaderTemplates
+	signer   assertionSigner
 	metrics  *proxyMetrics
+
+	forwarded     ForwardedMode
+	flushInterval time.Duration
+	maxBodyBytes  int64
+
+	closeUpgraded     chan struct{}
+	closeUpgradedOnce sync.Once
 }
 
 func New(opts ...Option) *Proxy {
 	c := &config{
-		logger: slog.Default(),
+		logger:        slog.Default(),
+		headers:       DefaultHeaderTemplates(),
+		flushInterval: defaultFlushInterval,
 	}
 
 	for _, opt := range opts {
@@ -43,7 +80,22 @@ func New(opts ...Option) *Proxy {
 		logger:   c.logger,
 		authz:    c.authz,
 		upstream: c.upstream,
+		routes:   c.routes,
+		jwt:      c.jwt,
+		denyList: c.denyList,
+		stripped: newHeaderSet(SPIFFEIDHeader, assertion.Header),
+		xfcc:     c.xfcc,
+		headers:  c.headers,
+		signer:   c.signer,
+
+		forwarded:     c.forwarded,
+		flushInterval: c.flushInterval,
+		maxBodyBytes:  c.maxBodyBytes,
+
+		closeUpgraded: make(chan struct{}),
 	}
+	p.stripped.add(c.stripHeaders...)
+	p.stripped.add(c.headers.Names()...)
 
 	if c.metrics != nil {
 		m := &proxyMetrics{
@@ -55,9 +107,36 @@ func New(opts ...Option) *Proxy {
 				Name: "proxy_authz_result_count",
 				Help: "A counter of AuthZ results.",
 			}, []string{"result"}),
+			authMethods: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "proxy_authn_method_count",
+				Help: "A counter of requests by the method used to authenticate the caller.",
+			}, []string{"method"}),
+			upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "proxy_upstream_error_count",
+				Help: "A counter of requests that failed to get a response from the upstream.",
+			}, []string{"reason"}),
+			upgraded: prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: "proxy_upgraded_connections",
+				Help: "A gauge of upgraded connections, like WebSockets, currently open.",
+			}),
+			upgradeCloses: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "proxy_upgraded_connection_close_count",
+				Help: "A counter of upgraded connections that were closed, by why they were closed.",
+			}, []string{"reason"}),
+			limits: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "proxy_limit_exceeded_count",
+				Help: "A counter of requests that took longer than the read or write timeout, by which one.",
+			}, []string{"limit"}),
+			bodyTooLarge: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: "proxy_body_too_large_count",
+				Help: "A counter of requests rejected because their body was over the limit, by the rule that set it.",
+			}, []string{"rule"}),
 		}
 
-		c.metrics.MustRegister(m.errors, m.results)
+		c.metrics.MustRegister(
+			m.errors, m.results, m.authMethods, m.upstreamErrors,
+			m.upgraded, m.upgradeCloses, m.limits, m.bodyTooLarge,
+		)
 
 		p.metrics = m
 	}
@@ -68,22 +147,47 @@ func New(opts ...Option) *Proxy {
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	clientCert := r.TLS.PeerCertificates[0]
-	spID, err := x509svid.IDFromCert(clientCert)
+	// Identity headers are only ever set by the proxy, so anything a caller
+	// sent with the same name is dropped before it can reach the upstream.
+	p.stripped.strip(r.Header)
+
+	caller, err := p.authenticate(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		p.logger.DebugContext(ctx, "could not parse uri into spiffeid")
-		p.metrics.Error("no_spiffeid")
+		ae := asAuthnError(err)
+		writeError(w, r, ae.status)
+		p.logger.DebugContext(ctx, "could not authenticate caller", "error", err)
+		p.metrics.Error(ae.reason)
 
 		return
 	}
 
-	logger := p.logger.With("spiffeid", spID.String())
+	spID, authMethod := caller.id, caller.authMethod
+	logger := p.logger.With("spiffeid", spID.String(), "authMethod", authMethod)
+	p.metrics.AuthMethod(authMethod)
+
+	if p.denyList != nil && !spID.IsZero() {
+		if err := p.denyList.CheckDenied(spID, caller.cert); err != nil {
+			writeError(w, r, http.StatusForbidden)
+			logger.WarnContext(ctx, "denied", "error", err)
+			p.metrics.Result("denied")
+
+			return
+		}
+	}
 
 	ctx = spiffeidutil.WithSPIFFEID(ctx, spID)
-	err = p.authz.Authorize(ctx, spID, r.Method, r.URL.Path)
+	ctx = spiffeidutil.WithAuthMethod(ctx, authMethod)
+	route, err := p.authorize(ctx, spID, r.Method, r.URL.Path)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
+		if spID.IsZero() {
+			writeError(w, r, http.StatusUnauthorized)
+			logger.DebugContext(ctx, "unauthenticated", "error", err)
+			p.metrics.Result("unauthenticated")
+
+			return
+		}
+
+		writeError(w, r, http.StatusForbidden)
 		logger.DebugContext(ctx, "unauthorized", "error", err)
 		p.metrics.Result("unauthorized")
 
@@ -92,6 +196,17 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	p.metrics.Result("authorized")
 
+	bodyLimit := p.bodyLimit(route)
+	if bodyLimit.exceededBy(r.ContentLength) {
+		writeError(w, r, http.StatusRequestEntityTooLarge)
+		logger.InfoContext(ctx, "request body too large", "contentLength", r.ContentLength, "limit", bodyLimit.bytes)
+		p.metrics.BodyTooLarge(bodyLimit.rule)
+
+		return
+	}
+
+	limits := applyLimits(w, r, route, bodyLimit)
+
 	upstreamURL := &url.URL{}
 	*upstreamURL = *r.URL
 	upstreamURL.Scheme = "http"
@@ -103,37 +218,185 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// configured upstream server.
 	req, err := http.NewRequestWithContext(ctx, r.Method, upstreamURL.String(), r.Body) //#nosec G704
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError)
 		logger.ErrorContext(ctx, "error creating upstream request", "error", err)
 
 		return
 	}
 
-	maps.Copy(req.Header, r.Header)
-	req.Header.Add("Host", r.Host)
-	req.Header.Add("Spiffe-Id", spID.String())
-	resp, err := p.upstream.Proxy(req)
+	// The body is forwarded with the framing it arrived with: with its
+	// Content-Length, if it had one, or chunked. A body known to be empty
+	// isn't sent at all.
+	req.ContentLength = r.ContentLength
+	if r.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	req.Host = r.Host
+	req.Header = r.Header.Clone()
+	removeHopByHop(req.Header)
+	// gRPC needs to know the upstream will send trailers, and an upgrade
+	// has to be requested again on the connection to the upstream.
+	if slices.ContainsFunc(r.Header.Values("Te"), isTrailersToken) {
+		req.Header.Set("Te", "trailers")
+	}
+	if upgrade := upgradeType(r.Header); upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	addVia(req.Header, r.ProtoMajor, r.ProtoMinor)
+	p.forwarded.apply(req.Header, r)
+
+	var peerCerts []*x509.Certificate
+	if authMethod == spiffeidutil.AuthMethodX509 {
+		peerCerts = r.TLS.PeerCertificates
+	}
+
+	up := p.upstreamFor(r.URL.Path)
+
+	if !spID.IsZero() {
+		if err := p.headers.apply(req.Header, caller); err != nil {
+			writeError(w, r, http.StatusInternalServerError)
+			logger.ErrorContext(ctx, "error rendering upstream headers", "error", err)
+
+			return
+		}
+
+		if p.signer != nil {
+			token, err := p.signer.Sign(spID, upstreamName(up), r.Method, r.URL.Path)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError)
+				logger.ErrorContext(ctx, "error signing identity assertion", "error", err)
+
+				return
+			}
+			req.Header.Set(assertion.Header, token)
+		}
+	}
+
+	p.xfcc.apply(req.Header, spID, peerCerts)
+
+	// Informational responses, like 103 Early Hints, are passed on as they
+	// arrive.
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			h := w.Header()
+			maps.Copy(h, http.Header(header))
+			removeHopByHop(h)
+			w.WriteHeader(code)
+			// WriteHeader keeps the headers of a 1xx response, so they're
+			// cleared to keep them out of the final response.
+			clear(h)
+
+			return nil
+		},
+	}))
+
+	resp, err := up.Proxy(req)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		logger.ErrorContext(ctx, "error connecting to upstream", "error", err)
+		if limits.bodyTooLarge.Load() {
+			writeError(w, r, http.StatusRequestEntityTooLarge)
+			logger.InfoContext(ctx, "request body too large", "limit", bodyLimit.bytes)
+			p.metrics.BodyTooLarge(bodyLimit.rule)
+
+			return
+		}
+
+		if limits.readTimedOut() {
+			writeError(w, r, http.StatusRequestTimeout)
+			logger.InfoContext(ctx, "timed out reading request body", "error", err)
+			p.metrics.LimitExceeded("read_timeout")
+
+			return
+		}
+
+		status, reason := classifyUpstreamError(ctx, err)
+		p.metrics.UpstreamError(reason)
+
+		if status == statusClientClosedRequest {
+			// There's nobody left to answer. Abort the response instead of
+			// writing one, so 499 only shows up in logs and the inbound
+			// metrics don't count a response that was never sent.
+			logger.InfoContext(ctx, "client canceled request", "error", err, "status", status)
+			panic(http.ErrAbortHandler)
+		}
+
+		writeError(w, r, status)
+		logger.ErrorContext(ctx, "error from upstream", "error", err, "status", status, "reason", reason)
 
 		return
 	}
 
-	respHeader := w.Header()
-	maps.Copy(respHeader, resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
+	// Closing the body also stops the upstream request, if the caller went
+	// away before the response was finished.
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		p.serveUpgrade(w, r, resp, caller, logger)
+
+		return
+	}
+
+	if err := copyResponse(w, resp, p.flushInterval); err != nil {
+		if limits.writeTimedOut() {
+			logger.InfoContext(ctx, "timed out writing response", "error", err)
+			p.metrics.LimitExceeded("write_timeout")
+
+			return
+		}
+
 		logger.ErrorContext(ctx, "failed to write response", "error", err)
 	}
 }
 
-type config struct {
-	logger   *slog.Logger
+// upstreamFor returns the upstream of the first route that matches path, or
+// the default upstream if none do.
+func (p *Proxy) upstreamFor(path string) upstreamer {
+	for _, route := range p.routes {
+		if route.match(path) {
+			return route.upstream
+		}
+	}
+
+	return p.upstream
+}
+
+// upstreamName returns the name of u, or an empty string if it has none.
+func upstreamName(u upstreamer) string {
+	if named, ok := u.(namedUpstream); ok {
+		return named.Name()
+	}
+
+	return ""
+}
+
+type upstreamRoute struct {
+	patterns []string
 	upstream upstreamer
-	authz    proxyAuthorizer
-	metrics  prometheus.Registerer
+}
+
+func (r *upstreamRoute) match(path string) bool {
+	return slices.ContainsFunc(r.patterns, func(pattern string) bool {
+		return authorizer.MatchFullPath(pattern, path)
+	})
+}
+
+type config struct {
+	logger       *slog.Logger
+	upstream     upstreamer
+	routes       []upstreamRoute
+	authz        proxyAuthorizer
+	jwt          *jwtAuth
+	denyList     denier
+	stripHeaders []string
+	xfcc         *xfccConfig
+	headers      *HeaderTemplates
+	signer       assertionSigner
+	metrics      prometheus.Registerer
+
+	forwarded     ForwardedMode
+	flushInterval time.Duration
+	maxBodyBytes  int64
 }
 
 type Option interface {
@@ -163,6 +426,106 @@ func WithUpstream(u upstreamer) Option {
 	})
 }
 
+// WithUpstreamRoute sends requests for paths that match any of patterns to u
+// instead of the default upstream. Routes are tried in the order they are
+// added, and patterns use the same syntax as the authorization policy, but
+// must match every segment, like authorizer.MatchFullPath.
+func WithUpstreamRoute(u upstreamer, patterns ...string) Option {
+	return optionFunc(func(c *config) {
+		c.routes = append(c.routes, upstreamRoute{
+			patterns: patterns,
+			upstream: u,
+		})
+	})
+}
+
+// WithJWTAuth allows callers without an X509-SVID to authenticate with a
+// JWT-SVID bearer token, validated against bundles and one of audiences.
+func WithJWTAuth(bundles jwtbundle.Source, audiences ...string) Option {
+	return optionFunc(func(c *config) {
+		c.jwt = &jwtAuth{
+			bundles:   bundles,
+			audiences: audiences,
+		}
+	})
+}
+
+// WithDenyList rejects callers whose SPIFFE ID or certificate d reports as
+// denied, even if the authorizer would allow them.
+func WithDenyList(d denier) Option {
+	return optionFunc(func(c *config) {
+		c.denyList = d
+	})
+}
+
+// WithStrippedHeaders removes the named headers from every inbound request,
+// in addition to SPIFFEIDHeader. Names match regardless of case or of
+// underscores in place of hyphens.
+func WithStrippedHeaders(names ...string) Option {
+	return optionFunc(func(c *config) {
+		c.stripHeaders = append(c.stripHeaders, names...)
+	})
+}
+
+// WithXFCC forwards the caller's verified certificate details to the
+// upstream in an Envoy-style X-Forwarded-Client-Cert header. With
+// includeChain, the PEM-encoded certificate and chain are included as well.
+func WithXFCC(mode XFCCMode, includeChain bool) Option {
+	return optionFunc(func(c *config) {
+		c.xfcc = &xfccConfig{
+			mode:         mode,
+			includeChain: includeChain,
+		}
+	})
+}
+
+// WithHeaderTemplates replaces the headers that identify the caller to the
+// upstream. By default, only SPIFFEIDHeader is set. Any inbound header with
+// one of these names is stripped.
+func WithHeaderTemplates(h *HeaderTemplates) Option {
+	return optionFunc(func(c *config) {
+		c.headers = h
+	})
+}
+
+// WithAssertionSigner adds a signed identity assertion for the caller to
+// every upstream request, in the assertion.Header header. Its audience is the
+// name of the upstream the request goes to.
+func WithAssertionSigner(s assertionSigner) Option {
+	return optionFunc(func(c *config) {
+		c.signer = s
+	})
+}
+
+// WithForwarded sets the Forwarded and X-Forwarded-* headers on upstream
+// requests according to mode. By default, inbound headers are passed on
+// untouched and nothing is added.
+func WithForwarded(mode ForwardedMode) Option {
+	return optionFunc(func(c *config) {
+		c.forwarded = mode
+	})
+}
+
+// WithFlushInterval sets how long a streamed response body may be buffered
+// before it is flushed to the caller. Zero flushes only when the buffer is
+// full, and a negative interval flushes after every write. Server-Sent
+// Events and gRPC responses are always flushed after every write. The
+// default is 100ms.
+func WithFlushInterval(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.flushInterval = d
+	})
+}
+
+// WithMaxBodyBytes rejects requests with bodies larger than n bytes with a
+// 413, unless the route that allowed them sets its own limit. Zero, the
+// default, means no limit.
+func WithMaxBodyBytes(n int64) Option {
+	return optionFunc(func(c *config) {
+		c.maxBodyBytes = n
+	})
+}
+
 func WithMetrics(r prometheus.Registerer) Option {
 	return optionFunc(func(c *config) {
 		c.metrics = r
@@ -170,8 +533,14 @@ func WithMetrics(r prometheus.Registerer) Option {
 }
 
 type proxyMetrics struct {
-	errors  *prometheus.CounterVec
-	results *prometheus.CounterVec
+	errors         *prometheus.CounterVec
+	results        *prometheus.CounterVec
+	authMethods    *prometheus.CounterVec
+	upstreamErrors *prometheus.CounterVec
+	upgraded       prometheus.Gauge
+	upgradeCloses  *prometheus.CounterVec
+	limits         *prometheus.CounterVec
+	bodyTooLarge   *prometheus.CounterVec
 }
 
 func (pm *proxyMetrics) Error(reason string) {
@@ -185,3 +554,44 @@ func (pm *proxyMetrics) Result(result string) {
 		pm.results.With(prometheus.Labels{"result": result}).Inc()
 	}
 }
+
+func (pm *proxyMetrics) AuthMethod(m spiffeidutil.AuthMethod) {
+	if pm != nil {
+		method := string(m)
+		if m == spiffeidutil.AuthMethodNone {
+			method = "none"
+		}
+		pm.authMethods.With(prometheus.Labels{"method": method}).Inc()
+	}
+}
+
+func (pm *proxyMetrics) UpstreamError(reason string) {
+	if pm != nil {
+		pm.upstreamErrors.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+}
+
+func (pm *proxyMetrics) UpgradeOpened() {
+	if pm != nil {
+		pm.upgraded.Inc()
+	}
+}
+
+func (pm *proxyMetrics) UpgradeClosed(reason string) {
+	if pm != nil {
+		pm.upgraded.Dec()
+		pm.upgradeCloses.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+}
+
+func (pm *proxyMetrics) LimitExceeded(limit string) {
+	if pm != nil {
+		pm.limits.With(prometheus.Labels{"limit": limit}).Inc()
+	}
+}
+
+func (pm *proxyMetrics) BodyTooLarge(rule string) {
+	if pm != nil {
+		pm.bodyTooLarge.With(prometheus.Labels{"rule": rule}).Inc()
+	}
+}
@@ -2,14 +2,23 @@ package proxyhandler_test
 
 import (
 	"context"
+	"crypto/x509"
 	_ "embed"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"os"
 	"strings"
+	"syscall"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
@@ -17,7 +26,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"jsocol.io/spiffe-authz-proxy/authorizer"
 	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+	"jsocol.io/spiffe-authz-proxy/tlsutil"
+	"jsocol.io/spiffe-authz-proxy/upstream"
 )
 
 //go:embed testdata/rootcert.pem
@@ -45,6 +57,45 @@ func (m mockAuthorizer) Authorize(
 	return m(ctx, spid, method, path)
 }
 
+// allowAll authorizes every request.
+type allowAll struct{}
+
+func (allowAll) Authorize(context.Context, spiffeid.ID, string, string) error {
+	return nil
+}
+
+type mockDenier func(spiffeid.ID, *x509.Certificate) error
+
+func (m mockDenier) CheckDenied(spid spiffeid.ID, cert *x509.Certificate) error {
+	return m(spid, cert)
+}
+
+type mockSigner func(spiffeid.ID, string, string, string) (string, error)
+
+func (m mockSigner) Sign(caller spiffeid.ID, audience, method, path string) (string, error) {
+	return m(caller, audience, method, path)
+}
+
+type mockRouteAuthorizer func(context.Context, spiffeid.ID, string, string) (authorizer.Route, error)
+
+func (m mockRouteAuthorizer) Authorize(
+	ctx context.Context,
+	spid spiffeid.ID,
+	method, path string,
+) error {
+	_, err := m(ctx, spid, method, path)
+
+	return err
+}
+
+func (m mockRouteAuthorizer) AuthorizeRoute(
+	ctx context.Context,
+	spid spiffeid.ID,
+	method, path string,
+) (authorizer.Route, error) {
+	return m(ctx, spid, method, path)
+}
+
 type mockUpstream func(*http.Request) (*http.Response, error)
 
 func (m mockUpstream) Proxy(r *http.Request) (*http.Response, error) {
@@ -141,7 +192,284 @@ func TestProxy_Unauthorized(t *testing.T) {
 	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
 }
 
-func newTestClientServer(t *testing.T, handler http.Handler) (*httptest.Server, *http.Client) {
+func TestProxy_UpstreamRoutes(t *testing.T) {
+	named := func(name string) mockUpstream {
+		return func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(name)),
+			}, nil
+		}
+	}
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(named("default")),
+		proxyhandler.WithUpstreamRoute(named("api"), "/api/**"),
+		proxyhandler.WithUpstreamRoute(named("admin"), "/admin/**", "/debug/*"),
+		proxyhandler.WithUpstreamRoute(named("shadowed"), "/api/v2/**"),
+	)
+
+	tests := map[string]string{
+		"/api/widgets":      "api",
+		"/api/v2/widgets":   "api",
+		"/admin/users/1":    "admin",
+		"/debug/vars":       "admin",
+		"/debug/pprof/heap": "default",
+		"/debug":            "default",
+		"/api":              "api",
+		"/widgets":          "default",
+	}
+
+	for path, expected := range tests {
+		t.Run(path, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+path, http.NoBody)
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, expected, string(body))
+		})
+	}
+}
+
+func TestProxy_UpstreamErrors(t *testing.T) {
+	tests := map[string]struct {
+		err    error
+		status int
+	}{
+		"refused": {
+			err:    &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			status: http.StatusBadGateway,
+		},
+		"reset": {
+			err:    &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			status: http.StatusBadGateway,
+		},
+		"deadline": {
+			err:    fmt.Errorf("waiting for upstream: %w", context.DeadlineExceeded),
+			status: http.StatusGatewayTimeout,
+		},
+		"timeout": {
+			err:    &net.OpError{Op: "dial", Err: timeoutError{}},
+			status: http.StatusGatewayTimeout,
+		},
+		"no healthy endpoints": {
+			err:    upstream.ErrNoHealthyEndpoints,
+			status: http.StatusServiceUnavailable,
+		},
+		"other": {
+			err:    errors.New("malformed HTTP response"),
+			status: http.StatusBadGateway,
+		},
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+				return nil, tc.err
+			}
+
+			proxy := proxyhandler.New(
+				proxyhandler.WithAuthorizer(allowAll{}),
+				proxyhandler.WithUpstream(up),
+				proxyhandler.WithMetrics(prometheus.WrapRegistererWith(prometheus.Labels{"test": name}, reg)),
+			)
+
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/my/path", http.NoBody))
+
+			assert.Equal(t, tc.status, rec.Code)
+		})
+	}
+
+	err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_upstream_error_count A counter of requests that failed to get a response from the upstream.
+# TYPE proxy_upstream_error_count counter
+proxy_upstream_error_count{reason="connection_refused",test="refused"} 1
+proxy_upstream_error_count{reason="connection_reset",test="reset"} 1
+proxy_upstream_error_count{reason="no_healthy_endpoints",test="no healthy endpoints"} 1
+proxy_upstream_error_count{reason="timeout",test="deadline"} 1
+proxy_upstream_error_count{reason="timeout",test="timeout"} 1
+proxy_upstream_error_count{reason="upstream_error",test="other"} 1
+`), "proxy_upstream_error_count")
+	require.NoError(t, err)
+}
+
+func TestProxy_ClientCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		cancel()
+
+		return nil, r.Context().Err()
+	}
+
+	proxy := proxyhandler.New(
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+	)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/my/path", http.NoBody)
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		proxy.ServeHTTP(rec, req)
+	})
+	assert.Empty(t, rec.Body.String())
+	assert.NotEqual(t, 499, rec.Code)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestProxy_Denied(t *testing.T) {
+	var denied mockDenier = func(spid spiffeid.ID, cert *x509.Certificate) error {
+		if cert != nil && spid.String() == "spiffe://example.org/workload" {
+			return errors.New("leaked")
+		}
+
+		return nil
+	}
+
+	var upstream mockUpstream = func(r *http.Request) (*http.Response, error) {
+		t.Fatalf("this should never be called")
+		return nil, nil //nolint:nilnil,nlreturn
+	}
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(upstream),
+		proxyhandler.WithDenyList(denied),
+	)
+
+	req, _ := http.NewRequestWithContext(
+		context.Background(),
+		http.MethodGet,
+		srv.URL+"/my/path",
+		http.NoBody,
+	)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestProxy_RequestFraming(t *testing.T) {
+	type framing struct {
+		contentLength    int64
+		transferEncoding []string
+		body             string
+	}
+	seen := make(chan framing, 1)
+	up := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- framing{r.ContentLength, r.TransferEncoding, string(body)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+	)
+
+	tests := map[string]struct {
+		method        string
+		body          string
+		contentLength int64
+		want          framing
+	}{
+		"content length": {
+			method:        http.MethodPost,
+			body:          "hello",
+			contentLength: 5,
+			want:          framing{contentLength: 5, body: "hello"},
+		},
+		"chunked": {
+			method:        http.MethodPost,
+			body:          "hello",
+			contentLength: -1,
+			want:          framing{contentLength: -1, transferEncoding: []string{"chunked"}, body: "hello"},
+		},
+		"empty body": {
+			method: http.MethodPost,
+			want:   framing{},
+		},
+		"no body": {
+			method: http.MethodGet,
+			want:   framing{},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var body io.Reader = http.NoBody
+			if tc.body != "" {
+				body = io.NopCloser(strings.NewReader(tc.body))
+			}
+			req, _ := http.NewRequestWithContext(context.Background(), tc.method, srv.URL+"/my/path", body)
+			req.ContentLength = tc.contentLength
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+			assert.Equal(t, tc.want, <-seen)
+		})
+	}
+}
+
+func TestProxy_InformationalResponses(t *testing.T) {
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		// A real transport reports 1xx responses through the trace.
+		trace := httptrace.ContextClientTrace(r.Context())
+		require.NotNil(t, trace)
+		err := trace.Got1xxResponse(http.StatusEarlyHints, textproto.MIMEHeader{
+			"Link": {"</style.css>; rel=preload; as=style"},
+		})
+		require.NoError(t, err)
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+	)
+
+	var hints []textproto.MIMEHeader
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header)
+			}
+
+			return nil
+		},
+	})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/my/path", http.NoBody)
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, hints, 1)
+	assert.Equal(t, "</style.css>; rel=preload; as=style", hints[0].Get("Link"))
+	assert.Empty(t, resp.Header.Get("Link"))
+}
+
+func testBundle(t *testing.T) *x509bundle.Bundle {
 	t.Helper()
 
 	bundle, err := x509bundle.Parse(
@@ -150,6 +478,29 @@ func newTestClientServer(t *testing.T, handler http.Handler) (*httptest.Server,
 	)
 	require.NoError(t, err)
 
+	return bundle
+}
+
+// newAnonymousTestClient returns a client that verifies the server's SVID but
+// does not present one of its own.
+func newAnonymousTestClient(t *testing.T) *http.Client {
+	t.Helper()
+
+	clientTLS := tlsconfig.TLSClientConfig(testBundle(t), tlsconfig.AuthorizeAny())
+	clientTLS.ServerName = "server.example.org"
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: clientTLS,
+		},
+	}
+}
+
+func newTestClientServer(t *testing.T, handler http.Handler) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	bundle := testBundle(t)
+
 	clientsvid, err := x509svid.Parse(append(workloadSVID, rootCert...), workloadKey)
 	require.NoError(t, err)
 
@@ -166,8 +517,36 @@ func newTestClientServer(t *testing.T, handler http.Handler) (*httptest.Server,
 	}
 
 	srv := httptest.NewUnstartedServer(handler)
-	srv.TLS = tlsconfig.MTLSServerConfig(serversvid, bundle, tlsconfig.AuthorizeAny())
+	srv.TLS = tlsutil.OptionalMTLSServerConfig(serversvid, bundle, tlsconfig.AuthorizeAny())
 	srv.TLS.ServerName = "server.example.org"
 
 	return srv, client
 }
+
+// startTestProxy starts a TLS server for a proxy with opts, and returns it
+// with a client that presents the workload SVID. The server is closed when
+// the test ends.
+func startTestProxy(t *testing.T, opts ...proxyhandler.Option) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	srv, client := newTestClientServer(t, proxyhandler.New(opts...))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv, client
+}
+
+// newTestUpstream returns an upstream that sends requests to a plaintext
+// server for handler. The server is closed when the test ends.
+func newTestUpstream(t *testing.T, handler http.Handler, opts ...upstream.Option) *upstream.Upstream {
+	t.Helper()
+
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+
+	opts = append([]upstream.Option{upstream.WithAddr(backend.Listener.Addr())}, opts...)
+	up, err := upstream.New(opts...)
+	require.NoError(t, err)
+
+	return up
+}
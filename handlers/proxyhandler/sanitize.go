@@ -0,0 +1,43 @@
+package proxyhandler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SPIFFEIDHeader is the header the proxy uses by default to tell the upstream
+// the caller's SPIFFE ID. It is always stripped from inbound requests.
+const SPIFFEIDHeader = "Spiffe-Id"
+
+// headerSet matches header names regardless of case, and treats underscores
+// and hyphens as the same, since many frameworks (CGI, WSGI, Rack, ...) map
+// both "Spiffe-Id" and "Spiffe_Id" to the same variable.
+type headerSet map[string]struct{}
+
+func newHeaderSet(names ...string) headerSet {
+	hs := make(headerSet, len(names))
+	for _, name := range names {
+		hs[normalizeHeaderName(name)] = struct{}{}
+	}
+
+	return hs
+}
+
+func (hs headerSet) add(names ...string) {
+	for _, name := range names {
+		hs[normalizeHeaderName(name)] = struct{}{}
+	}
+}
+
+// strip deletes every header in h that matches the set.
+func (hs headerSet) strip(h http.Header) {
+	for name := range h {
+		if _, ok := hs[normalizeHeaderName(name)]; ok {
+			delete(h, name)
+		}
+	}
+}
+
+func normalizeHeaderName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
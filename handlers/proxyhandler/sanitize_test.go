@@ -0,0 +1,110 @@
+package proxyhandler_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+)
+
+func TestProxy_StripsForgedIdentityHeaders(t *testing.T) {
+	var seen http.Header
+	up := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+		proxyhandler.WithStrippedHeaders("X-Caller-Namespace"),
+	)
+
+	req, _ := http.NewRequestWithContext(
+		context.Background(),
+		http.MethodGet,
+		srv.URL+"/my/path",
+		http.NoBody,
+	)
+	req.Header["Spiffe-Id"] = []string{"spiffe://example.org/forged"}
+	req.Header["SPIFFE-ID"] = []string{"spiffe://example.org/forged"}
+	req.Header["spiffe_id"] = []string{"spiffe://example.org/forged"}
+	req.Header["X_Caller_Namespace"] = []string{"kube-system"}
+	req.Header.Set("X-Unrelated", "kept")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	require.NotNil(t, seen)
+	assert.Equal(t, []string{"spiffe://example.org/workload"}, seen.Values("Spiffe-Id"))
+	assert.Equal(t, "kept", seen.Get("X-Unrelated"))
+	for name, values := range seen {
+		for _, v := range values {
+			assert.NotEqual(t, "spiffe://example.org/forged", v, "forged value in header %s", name)
+			assert.NotEqual(t, "kube-system", v, "forged value in header %s", name)
+		}
+	}
+}
+
+func TestProxy_HopByHopHeaders(t *testing.T) {
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		for _, name := range []string{
+			"Connection", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection", "Upgrade", "X-Per-Hop",
+		} {
+			assert.Empty(t, r.Header.Values(name), name)
+		}
+		assert.Equal(t, "trailers", r.Header.Get("Te"))
+		assert.Equal(t, "end-to-end", r.Header.Get("X-End-To-End"))
+		assert.Equal(t, "app.example.org", r.Host)
+		assert.Empty(t, r.Header.Values("Host"))
+		assert.Equal(t, []string{"1.0 front-proxy", "1.1 spiffe-authz-proxy"}, r.Header.Values("Via"))
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header: http.Header{
+				"Connection":         {"X-Resp-Per-Hop"},
+				"Keep-Alive":         {"timeout=5"},
+				"Proxy-Authenticate": {"Basic"},
+				"X-Resp-Per-Hop":     {"hop"},
+				"X-Resp-End-To-End":  {"end-to-end"},
+			},
+			Body: io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+	)
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/my/path", http.NoBody)
+	req.Host = "app.example.org"
+	req.Header.Set("Connection", "X-Per-Hop")
+	req.Header.Set("X-Per-Hop", "hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("Via", "1.0 front-proxy")
+	req.Header.Set("X-End-To-End", "end-to-end")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Values("Keep-Alive"))
+	assert.Empty(t, resp.Header.Values("Proxy-Authenticate"))
+	assert.Empty(t, resp.Header.Values("X-Resp-Per-Hop"))
+	assert.Equal(t, "end-to-end", resp.Header.Get("X-Resp-End-To-End"))
+	assert.Equal(t, "1.1 spiffe-authz-proxy", resp.Header.Get("Via"))
+}
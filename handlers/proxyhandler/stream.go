@@ -0,0 +1,136 @@
+package proxyhandler
+
+import (
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultFlushInterval is how long a response body may sit in the buffer
+// before it is flushed to the caller.
+const defaultFlushInterval = 100 * time.Millisecond
+
+// copyResponse writes resp to w. Server-Sent Events and gRPC messages are
+// flushed as soon as they arrive and other bodies at least every
+// flushInterval, or only when the buffer fills if flushInterval is zero.
+// Trailers are copied once the body is done.
+func copyResponse(w http.ResponseWriter, resp *http.Response, flushInterval time.Duration) error {
+	header := w.Header()
+	maps.Copy(header, resp.Header)
+	removeHopByHop(header)
+	addVia(header, resp.ProtoMajor, resp.ProtoMinor)
+
+	// Trailer values are only known after the body, but the names have to
+	// be announced before it.
+	announced := make([]string, 0, len(resp.Trailer))
+	for name := range resp.Trailer {
+		announced = append(announced, name)
+	}
+	if len(announced) > 0 {
+		header.Add("Trailer", strings.Join(announced, ", "))
+	}
+
+	latency := flushInterval
+	if contentType := resp.Header.Get("Content-Type"); isEventStream(contentType) || isGRPC(contentType) {
+		latency = -1
+	}
+
+	rc := http.NewResponseController(w)
+	w.WriteHeader(resp.StatusCode)
+	if latency < 0 {
+		_ = rc.Flush()
+	}
+
+	var dst io.Writer = w
+	if latency != 0 {
+		fw := &flushWriter{w: w, rc: rc, latency: latency}
+		defer fw.stop()
+		dst = fw
+	}
+
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		return err
+	}
+
+	// Trailers the upstream sent without announcing them need the prefix.
+	for name, values := range resp.Trailer {
+		if len(resp.Trailer) != len(announced) {
+			name = http.TrailerPrefix + name
+		}
+		header[name] = values
+	}
+
+	return nil
+}
+
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// flushWriter flushes every write immediately if latency is negative, or
+// otherwise no later than latency after the write.
+type flushWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	latency time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	if fw.latency < 0 {
+		return n, fw.rc.Flush()
+	}
+
+	if fw.pending {
+		return n, nil
+	}
+	fw.pending = true
+
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.latency, fw.delayedFlush)
+	} else {
+		fw.timer.Reset(fw.latency)
+	}
+
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	// stop may have run, and the handler returned, since the timer fired.
+	if !fw.pending {
+		return
+	}
+	fw.pending = false
+
+	_ = fw.rc.Flush()
+}
+
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
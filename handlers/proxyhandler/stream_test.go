@@ -0,0 +1,168 @@
+package proxyhandler_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+)
+
+// newStreamingUpstream returns an upstream whose response body is written
+// through the returned pipe, and a channel that is closed when the upstream
+// request's context is done.
+func newStreamingUpstream(header http.Header, trailer http.Header) (mockUpstream, *io.PipeWriter, <-chan struct{}) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		go func() {
+			<-r.Context().Done()
+			close(done)
+		}()
+
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			Trailer:       trailer,
+			Body:          pr,
+			ContentLength: -1,
+		}, nil
+	}
+
+	return up, pw, done
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+
+	return line
+}
+
+func TestProxy_Streaming(t *testing.T) {
+	tests := map[string]struct {
+		contentType   string
+		flushInterval time.Duration
+	}{
+		"event stream": {
+			contentType: "text/event-stream; charset=utf-8",
+			// even when periodic flushing is off
+			flushInterval: 0,
+		},
+		"periodic": {
+			contentType:   "application/x-ndjson",
+			flushInterval: 10 * time.Millisecond,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			up, pw, _ := newStreamingUpstream(http.Header{"Content-Type": {tc.contentType}}, nil)
+
+			srv, client := startTestProxy(t,
+				proxyhandler.WithAuthorizer(allowAll{}),
+				proxyhandler.WithUpstream(up),
+				proxyhandler.WithFlushInterval(tc.flushInterval),
+			)
+			defer pw.Close()
+
+			// Without an event stream, the headers are sent with the first
+			// flush of the body.
+			go func() { _, _ = io.WriteString(pw, "data: one\n") }()
+
+			// If a write isn't flushed, reading it blocks until the deadline.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", http.NoBody)
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.contentType, resp.Header.Get("Content-Type"))
+
+			body := bufio.NewReader(resp.Body)
+			assert.Equal(t, "data: one\n", readLine(t, body))
+
+			_, err = io.WriteString(pw, "data: two\n")
+			require.NoError(t, err)
+			assert.Equal(t, "data: two\n", readLine(t, body))
+
+			require.NoError(t, pw.Close())
+			rest, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Empty(t, rest)
+		})
+	}
+}
+
+func TestProxy_Trailers(t *testing.T) {
+	trailer := http.Header{"X-Checksum": nil}
+	up, pw, _ := newStreamingUpstream(http.Header{}, trailer)
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+	)
+
+	go func() {
+		_, _ = io.WriteString(pw, "some data")
+		// Like net/http, trailer values are filled in once the body is done.
+		trailer.Set("X-Checksum", "abc123")
+		_ = pw.Close()
+	}()
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/data", http.NoBody)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "some data", string(body))
+	assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestProxy_StreamingClientDisconnect(t *testing.T) {
+	up, pw, upstreamDone := newStreamingUpstream(http.Header{"Content-Type": {"text/event-stream"}}, nil)
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+	)
+	defer pw.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", http.NoBody)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+
+	_, err = io.WriteString(pw, "data: one\n")
+	require.NoError(t, err)
+	assert.Equal(t, "data: one\n", readLine(t, bufio.NewReader(resp.Body)))
+
+	cancel()
+	_ = resp.Body.Close()
+
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream request was not canceled")
+	}
+
+	// Further writes fail once the proxy closes the upstream body.
+	require.Eventually(t, func() bool {
+		_, err := io.WriteString(pw, "data: two\n")
+
+		return errors.Is(err, io.ErrClosedPipe)
+	}, 5*time.Second, 10*time.Millisecond)
+}
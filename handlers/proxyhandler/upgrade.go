@@ -0,0 +1,163 @@
+package proxyhandler
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upgradeType returns the protocol that h asks to switch to, like
+// "websocket", or "" if h isn't part of an upgrade.
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for token := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+
+	return ""
+}
+
+// serveUpgrade finishes a handshake the upstream accepted, by hijacking the
+// caller's connection and splicing it to the upstream's. The request was
+// authorized as usual before it was sent upstream. The connection is closed
+// when either side closes it, when the caller's SVID expires, since the
+// caller can't be authorized again after that, or when the caller is added
+// to the deny-list, or when CloseUpgraded is called.
+func (p *Proxy) serveUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response, caller identity, logger *slog.Logger) {
+	ctx := r.Context()
+
+	reqType, respType := upgradeType(r.Header), upgradeType(resp.Header)
+	if reqType == "" || !strings.EqualFold(reqType, respType) {
+		writeError(w, r, http.StatusBadGateway)
+		logger.ErrorContext(ctx, "upstream switched to an unexpected protocol", "requested", reqType, "protocol", respType)
+		p.metrics.UpstreamError("invalid_upgrade")
+
+		return
+	}
+
+	backend, ok := resp.Body.(io.ReadWriter)
+	if !ok {
+		writeError(w, r, http.StatusBadGateway)
+		logger.ErrorContext(ctx, "upstream connection can't be written to after upgrade", "protocol", respType)
+		p.metrics.UpstreamError("invalid_upgrade")
+
+		return
+	}
+
+	// Callers using HTTP/2 can't be hijacked, so the upstream's switch
+	// can't be passed on to them.
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway)
+		logger.ErrorContext(ctx, "could not hijack connection", "error", err, "protocol", respType)
+		p.metrics.UpstreamError("invalid_upgrade")
+
+		return
+	}
+	defer conn.Close()
+
+	// The server's deadlines were for the request, and an upgraded
+	// connection lasts as long as it's used.
+	_ = conn.SetDeadline(time.Time{})
+
+	// The 101 response has no body, so writing it only writes the headers.
+	handshake := *resp
+	handshake.Header = resp.Header.Clone()
+	removeHopByHop(handshake.Header)
+	handshake.Header.Set("Connection", "Upgrade")
+	handshake.Header.Set("Upgrade", respType)
+	addVia(handshake.Header, resp.ProtoMajor, resp.ProtoMinor)
+	handshake.Body = nil
+	if err := handshake.Write(brw); err != nil {
+		logger.ErrorContext(ctx, "failed to write upgrade response", "error", err, "protocol", respType)
+
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		logger.ErrorContext(ctx, "failed to write upgrade response", "error", err, "protocol", respType)
+
+		return
+	}
+
+	p.metrics.UpgradeOpened()
+	logger.DebugContext(ctx, "connection upgraded", "protocol", respType)
+
+	// Anything the caller sent after the handshake may already be buffered,
+	// so it's read through brw rather than straight from conn.
+	errc := make(chan error, 2)
+	go splice(errc, backend, brw.Reader)
+	go splice(errc, conn, backend)
+
+	var expired <-chan time.Time
+	if !caller.expires.IsZero() {
+		timer := time.NewTimer(time.Until(caller.expires))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	notifier, _ := p.denyList.(denyListNotifier)
+
+	// Returning closes both connections, which stops the other copy.
+	for {
+		// The channel is taken before checking, so an update in between
+		// isn't missed.
+		var denyUpdated <-chan struct{}
+		if notifier != nil && !caller.id.IsZero() {
+			denyUpdated = notifier.DenyListUpdated()
+			if err := p.denyList.CheckDenied(caller.id, caller.cert); err != nil {
+				p.metrics.UpgradeClosed("denied")
+				logger.WarnContext(ctx, "closing upgraded connection after the caller was denied", "error", err, "protocol", respType)
+
+				return
+			}
+		}
+
+		select {
+		case err := <-errc:
+			p.metrics.UpgradeClosed("closed")
+			if err != nil && !errors.Is(err, io.EOF) {
+				logger.DebugContext(ctx, "upgraded connection closed", "error", err, "protocol", respType)
+			}
+
+			return
+		case <-expired:
+			p.metrics.UpgradeClosed("svid_expired")
+			logger.InfoContext(ctx, "closing upgraded connection after the caller's SVID expired", "protocol", respType)
+
+			return
+		case <-p.closeUpgraded:
+			p.metrics.UpgradeClosed("shutdown")
+			logger.InfoContext(ctx, "closing upgraded connection for shutdown", "protocol", respType)
+
+			return
+		case <-denyUpdated:
+		}
+	}
+}
+
+// CloseUpgraded closes every upgraded connection, and any that are upgraded
+// later. The server doesn't track hijacked connections, so Shutdown doesn't
+// close them by itself; register CloseUpgraded with RegisterOnShutdown.
+func (p *Proxy) CloseUpgraded() {
+	p.closeUpgradedOnce.Do(func() {
+		close(p.closeUpgraded)
+	})
+}
+
+// denyListNotifier is implemented by deny-lists that can tell when they
+// change, like *authorizer.MemoryAuthorizer, so callers of upgraded
+// connections can be checked again.
+type denyListNotifier interface {
+	DenyListUpdated() <-chan struct{}
+}
+
+func splice(errc chan<- error, dst io.Writer, src io.Reader) {
+	_, err := io.Copy(dst, src)
+	errc <- err
+}
@@ -0,0 +1,295 @@
+package proxyhandler_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/authorizer"
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+)
+
+// newEchoUpgradeUpstream returns an upstream that accepts WebSocket
+// handshakes and then echoes whatever it reads.
+func newEchoUpgradeUpstream(t *testing.T) mockUpstream {
+	t.Helper()
+
+	return func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+
+		proxySide, upstreamSide := net.Pipe()
+		go func() {
+			_, _ = io.Copy(upstreamSide, upstreamSide)
+			_ = upstreamSide.Close()
+		}()
+
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header: http.Header{
+				"Connection": {"Upgrade"},
+				"Upgrade":    {"websocket"},
+			},
+			Body: proxySide,
+		}, nil
+	}
+}
+
+func newUpgradeRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	return req
+}
+
+func TestProxy_Upgrade(t *testing.T) {
+	var authz mockAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) error {
+		if method == http.MethodGet && path == "/ws" {
+			return nil
+		}
+
+		return errors.New("nope")
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(newEchoUpgradeUpstream(t)),
+		proxyhandler.WithMetrics(reg),
+	)
+
+	resp, err := client.Do(newUpgradeRequest(t, srv.URL+"/ws"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	require.True(t, ok)
+
+	body := bufio.NewReader(conn)
+	for _, msg := range []string{"hello\n", "again\n"} {
+		_, err = io.WriteString(conn, msg)
+		require.NoError(t, err)
+		assert.Equal(t, msg, readLine(t, body))
+	}
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_upgraded_connections A gauge of upgraded connections, like WebSockets, currently open.
+# TYPE proxy_upgraded_connections gauge
+proxy_upgraded_connections 1
+`), "proxy_upgraded_connections")
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Close())
+
+	assert.Eventually(t, func() bool {
+		return testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_upgraded_connection_close_count A counter of upgraded connections that were closed, by why they were closed.
+# TYPE proxy_upgraded_connection_close_count counter
+proxy_upgraded_connection_close_count{reason="closed"} 1
+# HELP proxy_upgraded_connections A gauge of upgraded connections, like WebSockets, currently open.
+# TYPE proxy_upgraded_connections gauge
+proxy_upgraded_connections 0
+`), "proxy_upgraded_connections", "proxy_upgraded_connection_close_count") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestProxy_UpgradeUnauthorized(t *testing.T) {
+	var authz mockAuthorizer = func(ctx context.Context, spid spiffeid.ID, method, path string) error {
+		return errors.New("nope")
+	}
+
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		t.Error("the upstream should not be called")
+
+		return nil, errors.New("unreachable")
+	}
+
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(authz),
+		proxyhandler.WithUpstream(up),
+	)
+
+	resp, err := client.Do(newUpgradeRequest(t, srv.URL+"/ws"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestProxy_UpgradeClosedWhenSVIDExpires(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	srv, _ := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(newEchoUpgradeUpstream(t)),
+		proxyhandler.WithJWTAuth(testJWTBundle(t), "spiffe://example.org/server"),
+		proxyhandler.WithMetrics(reg),
+	)
+
+	token := newTestJWTSVIDWithTTL(t, 2*time.Second, "spiffe://example.org/jwt-workload", "spiffe://example.org/server")
+	req := newUpgradeRequest(t, srv.URL+"/ws")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := newAnonymousTestClient(t).Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	require.True(t, ok)
+	defer conn.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(conn)
+		closed <- err
+	}()
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed when the SVID expired")
+	}
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_upgraded_connection_close_count A counter of upgraded connections that were closed, by why they were closed.
+# TYPE proxy_upgraded_connection_close_count counter
+proxy_upgraded_connection_close_count{reason="svid_expired"} 1
+`), "proxy_upgraded_connection_close_count")
+	require.NoError(t, err)
+}
+
+func TestProxy_UpgradeClosedWhenDenied(t *testing.T) {
+	denyList := &authorizer.MemoryAuthorizer{}
+	reg := prometheus.NewPedanticRegistry()
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(newEchoUpgradeUpstream(t)),
+		proxyhandler.WithDenyList(denyList),
+		proxyhandler.WithMetrics(reg),
+	)
+
+	resp, err := client.Do(newUpgradeRequest(t, srv.URL+"/ws"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	require.True(t, ok)
+	defer conn.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(conn)
+		closed <- err
+	}()
+
+	d, err := authorizer.NewDenyList([]string{"spiffe://example.org/workload"}, nil, nil)
+	require.NoError(t, err)
+	denyList.UpdateDenyList(d)
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed when the caller was denied")
+	}
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_upgraded_connection_close_count A counter of upgraded connections that were closed, by why they were closed.
+# TYPE proxy_upgraded_connection_close_count counter
+proxy_upgraded_connection_close_count{reason="denied"} 1
+`), "proxy_upgraded_connection_close_count")
+	require.NoError(t, err)
+}
+
+func TestProxy_UpgradeInvalid(t *testing.T) {
+	var up mockUpstream = func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header: http.Header{
+				"Connection": {"Upgrade"},
+				"Upgrade":    {"h2c"},
+			},
+			Body: http.NoBody,
+		}, nil
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	srv, client := startTestProxy(t,
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+		proxyhandler.WithMetrics(reg),
+	)
+
+	resp, err := client.Do(newUpgradeRequest(t, srv.URL+"/ws"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_upstream_error_count A counter of requests that failed to get a response from the upstream.
+# TYPE proxy_upstream_error_count counter
+proxy_upstream_error_count{reason="invalid_upgrade"} 1
+`), "proxy_upstream_error_count")
+	require.NoError(t, err)
+}
+
+func TestProxy_UpgradeClosedOnShutdown(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	proxy := proxyhandler.New(
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(newEchoUpgradeUpstream(t)),
+		proxyhandler.WithMetrics(reg),
+	)
+
+	srv, client := newTestClientServer(t, proxy)
+	srv.Config.RegisterOnShutdown(proxy.CloseUpgraded)
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := client.Do(newUpgradeRequest(t, srv.URL+"/ws"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	require.True(t, ok)
+	defer conn.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(conn)
+		closed <- err
+	}()
+
+	require.NoError(t, srv.Config.Shutdown(context.Background()))
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed on shutdown")
+	}
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proxy_upgraded_connection_close_count A counter of upgraded connections that were closed, by why they were closed.
+# TYPE proxy_upgraded_connection_close_count counter
+proxy_upgraded_connection_close_count{reason="shutdown"} 1
+`), "proxy_upgraded_connection_close_count")
+	require.NoError(t, err)
+}
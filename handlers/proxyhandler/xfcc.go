@@ -0,0 +1,116 @@
+package proxyhandler
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// XFCCHeader is Envoy's X-Forwarded-Client-Cert header.
+const XFCCHeader = "X-Forwarded-Client-Cert"
+
+// XFCCMode controls what the proxy does with the X-Forwarded-Client-Cert
+// header. The zero value leaves any inbound header untouched and adds
+// nothing.
+type XFCCMode string
+
+const (
+	XFCCOff XFCCMode = ""
+	// XFCCSanitize removes any inbound header and doesn't add one.
+	XFCCSanitize XFCCMode = "sanitize"
+	// XFCCAppend keeps any inbound header and appends the caller's details.
+	XFCCAppend XFCCMode = "append"
+	// XFCCReplace removes any inbound header and sets the caller's details.
+	XFCCReplace XFCCMode = "replace"
+)
+
+// ParseXFCCMode validates a mode from configuration.
+func ParseXFCCMode(s string) (XFCCMode, error) {
+	switch m := XFCCMode(strings.ToLower(s)); m {
+	case XFCCOff, XFCCSanitize, XFCCAppend, XFCCReplace:
+		return m, nil
+	default:
+		return XFCCOff, fmt.Errorf(
+			"unsupported XFCC mode %q, must be one of [%s, %s, %s]",
+			s, XFCCSanitize, XFCCAppend, XFCCReplace,
+		)
+	}
+}
+
+type xfccConfig struct {
+	mode         XFCCMode
+	includeChain bool
+}
+
+// apply sets the X-Forwarded-Client-Cert header on the upstream request. certs
+// are the certificates the caller presented, leaf first, and may be empty
+// if the caller did not authenticate with an X509-SVID.
+func (x *xfccConfig) apply(h http.Header, id spiffeid.ID, certs []*x509.Certificate) {
+	if x == nil {
+		return
+	}
+
+	switch x.mode {
+	case XFCCOff:
+		return
+	case XFCCSanitize:
+		h.Del(XFCCHeader)
+
+		return
+	case XFCCReplace:
+		h.Del(XFCCHeader)
+	case XFCCAppend:
+	}
+
+	if len(certs) == 0 {
+		return
+	}
+
+	element := xfccElement(id, certs, x.includeChain)
+	if prev := strings.Join(h.Values(XFCCHeader), ","); prev != "" {
+		element = prev + "," + element
+	}
+	h.Set(XFCCHeader, element)
+}
+
+// xfccElement formats one element of the header, in the same field order
+// that Envoy uses.
+func xfccElement(id spiffeid.ID, certs []*x509.Certificate, includeChain bool) string {
+	leaf := certs[0]
+	hash := sha256.Sum256(leaf.Raw)
+
+	fields := []string{"Hash=" + hex.EncodeToString(hash[:])}
+
+	if includeChain {
+		chain := make([]string, 0, len(certs))
+		for _, c := range certs {
+			chain = append(chain, encodePEM(c))
+		}
+		fields = append(fields,
+			"Cert="+quoteXFCC(url.PathEscape(chain[0])),
+			"Chain="+quoteXFCC(url.PathEscape(strings.Join(chain, ""))),
+		)
+	}
+
+	fields = append(fields,
+		"Subject="+quoteXFCC(leaf.Subject.String()),
+		"URI="+id.String(),
+	)
+
+	return strings.Join(fields, ";")
+}
+
+func encodePEM(c *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))
+}
+
+func quoteXFCC(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
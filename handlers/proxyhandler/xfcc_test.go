@@ -0,0 +1,100 @@
+package proxyhandler_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+)
+
+func TestProxy_XFCC(t *testing.T) {
+	leaf, err := x509svid.Parse(workloadSVID, workloadKey)
+	require.NoError(t, err)
+	leafHash := sha256.Sum256(leaf.Certificates[0].Raw)
+	element := "Hash=" + hex.EncodeToString(leafHash[:]) +
+		`;Subject="` + leaf.Certificates[0].Subject.String() + `"` +
+		";URI=spiffe://example.org/workload"
+
+	inbound := `Hash=abc;URI=spiffe://example.org/front-proxy`
+
+	cases := []struct {
+		mode     proxyhandler.XFCCMode
+		expected []string
+	}{
+		{proxyhandler.XFCCOff, []string{inbound}},
+		{proxyhandler.XFCCSanitize, nil},
+		{proxyhandler.XFCCReplace, []string{element}},
+		{proxyhandler.XFCCAppend, []string{inbound + "," + element}},
+	}
+
+	for _, tc := range cases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			var upstream mockUpstream = func(r *http.Request) (*http.Response, error) {
+				assert.Equal(t, tc.expected, r.Header.Values(proxyhandler.XFCCHeader))
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader("ok")),
+				}, nil
+			}
+
+			srv, client := startTestProxy(t,
+				proxyhandler.WithAuthorizer(allowAll{}),
+				proxyhandler.WithUpstream(upstream),
+				proxyhandler.WithXFCC(tc.mode, false),
+			)
+
+			req, _ := http.NewRequestWithContext(
+				context.Background(),
+				http.MethodGet,
+				srv.URL+"/my/path",
+				http.NoBody,
+			)
+			req.Header.Set(proxyhandler.XFCCHeader, inbound)
+
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+
+	t.Run("with chain", func(t *testing.T) {
+		var upstream mockUpstream = func(r *http.Request) (*http.Response, error) {
+			xfcc := r.Header.Get(proxyhandler.XFCCHeader)
+			assert.Contains(t, xfcc, `Cert="-----BEGIN%20CERTIFICATE-----%0A`)
+			assert.Contains(t, xfcc, `;Chain="-----BEGIN%20CERTIFICATE-----%0A`)
+			assert.True(t, strings.HasSuffix(xfcc, ";URI=spiffe://example.org/workload"))
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("ok")),
+			}, nil
+		}
+
+		srv, client := startTestProxy(t,
+			proxyhandler.WithAuthorizer(allowAll{}),
+			proxyhandler.WithUpstream(upstream),
+			proxyhandler.WithXFCC(proxyhandler.XFCCReplace, true),
+		)
+
+		req, _ := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodGet,
+			srv.URL+"/my/path",
+			http.NoBody,
+		)
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+}
@@ -26,7 +26,12 @@ func New(opts ...Option) *http.Server {
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/health", http.StripPrefix("/health", c.HealthHandler))
+	if c.HealthHandler != nil {
+		mux.Handle("/health/", http.StripPrefix("/health", c.HealthHandler))
+	}
+	if c.MetricsHandler != nil {
+		mux.Handle("/metrics", c.MetricsHandler)
+	}
 
 	srv := &http.Server{
 		Addr:        c.Addr,
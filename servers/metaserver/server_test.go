@@ -0,0 +1,137 @@
+package metaserver_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/handlers/healthhandler"
+	"jsocol.io/spiffe-authz-proxy/handlers/metricshandler"
+	"jsocol.io/spiffe-authz-proxy/handlers/proxyhandler"
+	"jsocol.io/spiffe-authz-proxy/servers/metaserver"
+	"jsocol.io/spiffe-authz-proxy/servers/proxyserver"
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+type allowAll struct{}
+
+func (allowAll) Authorize(context.Context, spiffeid.ID, string, string) error {
+	return nil
+}
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// newMetaServer returns a meta server for a proxy that has already proxied
+// one traced request, so its metrics have been recorded.
+func newMetaServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+
+	up, err := upstream.New(
+		upstream.WithName("default"),
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithMetrics(reg),
+	)
+	require.NoError(t, err)
+
+	proxy := proxyhandler.New(
+		proxyhandler.WithAuthorizer(allowAll{}),
+		proxyhandler.WithUpstream(up),
+		proxyhandler.WithMetrics(reg),
+	)
+	front := httptest.NewServer(proxyserver.New(
+		proxyserver.WithProxyHandler(proxy),
+		proxyserver.WithMetrics(reg),
+	).Handler)
+	t.Cleanup(front.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/", http.NoBody)
+	req.Header.Set("Traceparent", traceParent)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	meta := httptest.NewServer(metaserver.New(
+		metaserver.WithHealthHandler(healthhandler.New()),
+		metaserver.WithMetricsHandler(metricshandler.New(metricshandler.WithRegistry(reg))),
+	).Handler)
+	t.Cleanup(meta.Close)
+
+	return meta
+}
+
+func scrape(t *testing.T, url, accept string) (string, string) {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, url, http.NoBody)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp.Header.Get("Content-Type"), string(body)
+}
+
+func TestMetaServer_Metrics(t *testing.T) {
+	meta := newMetaServer(t)
+
+	contentType, body := scrape(t, meta.URL+"/metrics", "")
+	assert.Contains(t, contentType, "text/plain")
+
+	for _, family := range []string{
+		"proxy_authz_result_count",
+		"upstream_http_request_count",
+		"inbound_http_request_count",
+		"go_goroutines",
+		"process_cpu_seconds_total",
+	} {
+		assert.Contains(t, body, "\n# TYPE "+family+" ", family)
+	}
+}
+
+func TestMetaServer_OpenMetrics(t *testing.T) {
+	meta := newMetaServer(t)
+
+	contentType, body := scrape(t, meta.URL+"/metrics", "application/openmetrics-text; version=1.0.0")
+	assert.Contains(t, contentType, "application/openmetrics-text")
+	assert.Regexp(t, `\nupstream_http_request_count\{[^}]*\} 1\.0 # \{trace_id="4bf92f3577b34da6a3ce929d0e0e4736"\}`, body)
+	assert.Regexp(t, `\ninbound_http_request_count\{[^}]*\} 1\.0 # \{trace_id="4bf92f3577b34da6a3ce929d0e0e4736"\}`, body)
+	assert.Contains(t, body, "# EOF")
+}
+
+func TestMetaServer_Health(t *testing.T) {
+	meta := newMetaServer(t)
+
+	resp, err := http.Get(meta.URL + "/health/live")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -7,12 +7,17 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"jsocol.io/spiffe-authz-proxy/traceutil"
 )
 
 type config struct {
 	Addr              string
 	ReadTimeout       time.Duration
 	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
 	ProxyHandler      http.Handler
 	TLSConfig         *tls.Config
 	Metrics           prometheus.Registerer
@@ -21,8 +26,10 @@ type config struct {
 func defaultConfig() *config {
 	return &config{
 		Addr:              ":8443",
-		ReadTimeout:       time.Second,
-		ReadHeaderTimeout: time.Second,
+		ReadTimeout:       time.Minute,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
 	}
 }
 
@@ -38,6 +45,9 @@ func New(opts ...Option) *http.Server {
 		DisableGeneralOptionsHandler: true,
 		ReadTimeout:                  c.ReadTimeout,
 		ReadHeaderTimeout:            c.ReadHeaderTimeout,
+		WriteTimeout:                 c.WriteTimeout,
+		IdleTimeout:                  c.IdleTimeout,
+		MaxHeaderBytes:               c.MaxHeaderBytes,
 		TLSConfig:                    c.TLSConfig,
 	}
 
@@ -60,11 +70,16 @@ func New(opts ...Option) *http.Server {
 
 		c.Metrics.MustRegister(reqCount, reqDuration, reqInFlight)
 
-		h.Handler = promhttp.InstrumentHandlerCounter(reqCount,
-			promhttp.InstrumentHandlerDuration(reqDuration,
+		// Requests that are part of a trace are linked to it in exemplars.
+		exemplar := promhttp.WithExemplarFromContext(traceutil.Exemplar)
+		h.Handler = traceutil.Handler(promhttp.InstrumentHandlerCounter(reqCount,
+			// promhttp only fills in the code and method labels.
+			promhttp.InstrumentHandlerDuration(reqDuration.MustCurryWith(prometheus.Labels{"handler": "proxy"}),
 				promhttp.InstrumentHandlerInFlight(reqInFlight, h.Handler),
+				exemplar,
 			),
-		)
+			exemplar,
+		))
 	}
 
 	return h
@@ -104,6 +119,30 @@ func WithReadHeaderTimeout(t time.Duration) Option {
 	})
 }
 
+// WithWriteTimeout limits how long writing each response may take. Zero
+// means no limit, which streamed responses need.
+func WithWriteTimeout(t time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.WriteTimeout = t
+	})
+}
+
+// WithIdleTimeout limits how long a keep-alive connection waits for its next
+// request.
+func WithIdleTimeout(t time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.IdleTimeout = t
+	})
+}
+
+// WithMaxHeaderBytes limits the size of each request's headers, including
+// the request line.
+func WithMaxHeaderBytes(n int) Option {
+	return optionFunc(func(c *config) {
+		c.MaxHeaderBytes = n
+	})
+}
+
 func WithTLSConfig(t *tls.Config) Option {
 	return optionFunc(func(c *config) {
 		c.TLSConfig = t
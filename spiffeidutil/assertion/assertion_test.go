@@ -0,0 +1,176 @@
+package assertion_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil/assertion"
+)
+
+func TestSignVerify(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	proxyID := spiffeid.RequireFromString("spiffe://example.org/proxy")
+	caller := spiffeid.RequireFromString("spiffe://example.org/caller")
+
+	bundle, svid := newTestSVID(t, td, proxyID)
+	signer := assertion.NewSigner(svid, 0)
+	verifier := assertion.NewVerifier(bundle, spiffeid.MatchID(proxyID), "default")
+
+	token, err := signer.Sign(caller, "default", http.MethodPost, "/foo/bar")
+	require.NoError(t, err)
+
+	t.Run("valid", func(t *testing.T) {
+		claims, err := verifier.Verify(token, http.MethodPost, "/foo/bar")
+		require.NoError(t, err)
+
+		actual, err := claims.Caller()
+		require.NoError(t, err)
+		assert.Equal(t, caller, actual)
+		assert.Equal(t, proxyID.String(), claims.Issuer)
+		assert.Equal(t, jwt.Audience{"default"}, claims.Audience)
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		_, err := verifier.Verify(token, http.MethodGet, "/foo/bar")
+		require.Error(t, err)
+
+		_, err = verifier.Verify(token, http.MethodPost, "/foo/baz")
+		require.Error(t, err)
+	})
+
+	t.Run("untrusted proxy", func(t *testing.T) {
+		other := assertion.NewVerifier(
+			bundle,
+			spiffeid.MatchID(spiffeid.RequireFromString("spiffe://example.org/other-proxy")),
+			"default",
+		)
+
+		_, err := other.Verify(token, http.MethodPost, "/foo/bar")
+		require.Error(t, err)
+	})
+
+	t.Run("other upstream", func(t *testing.T) {
+		other := assertion.NewVerifier(bundle, spiffeid.MatchID(proxyID), "api")
+		_, err := other.Verify(token, http.MethodPost, "/foo/bar")
+		require.Error(t, err)
+	})
+
+	t.Run("untrusted bundle", func(t *testing.T) {
+		otherBundle, _ := newTestSVID(t, td, proxyID)
+		other := assertion.NewVerifier(otherBundle, spiffeid.MatchID(proxyID), "default")
+
+		_, err := other.Verify(token, http.MethodPost, "/foo/bar")
+		require.Error(t, err)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		_, err := verifier.Verify(token[:len(token)-4]+"AAAA", http.MethodPost, "/foo/bar")
+		require.Error(t, err)
+	})
+}
+
+func TestVerifier_Middleware(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	proxyID := spiffeid.RequireFromString("spiffe://example.org/proxy")
+	caller := spiffeid.RequireFromString("spiffe://example.org/caller")
+
+	bundle, svid := newTestSVID(t, td, proxyID)
+	signer := assertion.NewSigner(svid, time.Minute)
+	verifier := assertion.NewVerifier(bundle, spiffeid.MatchID(proxyID), "default")
+
+	var seen spiffeid.ID
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = spiffeidutil.FromContext(r.Context())
+	}))
+
+	t.Run("missing", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/foo", http.NoBody))
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		token, err := signer.Sign(caller, "default", http.MethodGet, "/foo")
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/foo", http.NoBody)
+		req.Header.Set(assertion.Header, token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, caller, seen)
+	})
+
+	t.Run("replayed to another path", func(t *testing.T) {
+		token, err := signer.Sign(caller, "default", http.MethodGet, "/foo")
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/admin", http.NoBody)
+		req.Header.Set(assertion.Header, token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
+
+// newTestSVID creates a new CA for td and an X509-SVID for id signed by it.
+func newTestSVID(t *testing.T, td spiffeid.TrustDomain, id spiffeid.ID) (*x509bundle.Bundle, *x509svid.SVID) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		URIs:                  []*url.URL{td.ID().URL()},
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		URIs:         []*url.URL{id.URL()},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return x509bundle.FromX509Authorities(td, []*x509.Certificate{ca}), &x509svid.SVID{
+		ID:           id,
+		Certificates: []*x509.Certificate{leaf},
+		PrivateKey:   key,
+	}
+}
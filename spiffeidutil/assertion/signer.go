@@ -0,0 +1,82 @@
+package assertion
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// DefaultTTL is how long an assertion is valid for by default. Assertions
+// are minted per request, so this only needs to cover clock skew and the
+// time it takes the upstream to start handling the request.
+const DefaultTTL = 30 * time.Second
+
+// Signer mints assertions with the current X509-SVID from a source, so
+// that assertions keep working as the SVID rotates.
+type Signer struct {
+	svids x509svid.Source
+	ttl   time.Duration
+}
+
+// NewSigner returns a Signer. A ttl of zero means DefaultTTL.
+func NewSigner(svids x509svid.Source, ttl time.Duration) *Signer {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Signer{
+		svids: svids,
+		ttl:   ttl,
+	}
+}
+
+// Sign returns a compact JWT asserting that caller was authorized to make a
+// request with method to path on the upstream named audience. The SVID's
+// certificate chain is embedded in the x5c header so the verifier only needs
+// the trust bundle.
+func (s *Signer) Sign(caller spiffeid.ID, audience, method, path string) (string, error) {
+	svid, err := s.svids.GetX509SVID()
+	if err != nil {
+		return "", err
+	}
+
+	alg, err := algorithmFor(svid.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	x5c := make([]string, 0, len(svid.Certificates))
+	for _, cert := range svid.Certificates {
+		x5c = append(x5c, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+
+	opts := new(jose.SignerOptions).
+		WithType("JWT").
+		WithHeader(jose.HeaderKey("x5c"), x5c)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: svid.PrivateKey}, opts)
+	if err != nil {
+		return "", fmt.Errorf("could not create signer: %w", err)
+	}
+
+	now := time.Now()
+	claims := Claims{
+		Claims: jwt.Claims{
+			Issuer:    svid.ID.String(),
+			Subject:   caller.String(),
+			Audience:  jwt.Audience{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(s.ttl)),
+		},
+		Method: method,
+		Path:   path,
+	}
+
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
@@ -0,0 +1,158 @@
+package assertion
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+
+	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
+)
+
+// leeway allows for clock skew between the proxy and the upstream.
+const leeway = 5 * time.Second
+
+// Verifier checks assertions minted by a Signer.
+type Verifier struct {
+	bundles  x509bundle.Source
+	proxies  spiffeid.Matcher
+	audience string
+}
+
+// NewVerifier returns a Verifier that trusts assertions signed by an
+// X509-SVID that chains to bundles and whose SPIFFE ID matches proxies, for
+// instance spiffeid.MatchID of the proxy's own ID. Only assertions minted for
+// audience, the name the proxy gives this upstream, are accepted, so that one
+// upstream can't replay an assertion to another.
+func NewVerifier(bundles x509bundle.Source, proxies spiffeid.Matcher, audience string) *Verifier {
+	return &Verifier{
+		bundles:  bundles,
+		proxies:  proxies,
+		audience: audience,
+	}
+}
+
+// Verify checks the signature, lifetime and audience of token, and that it
+// was minted for a request with method and path.
+func (v *Verifier) Verify(token, method, path string) (*Claims, error) {
+	tok, err := jwt.ParseSigned(token, allowedAlgorithms())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse assertion: %w", err)
+	}
+
+	unverified := &Claims{}
+	if err := tok.UnsafeClaimsWithoutVerification(unverified); err != nil {
+		return nil, fmt.Errorf("could not read assertion claims: %w", err)
+	}
+
+	issuer, err := spiffeid.FromString(unverified.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid assertion issuer: %w", err)
+	}
+
+	if err := v.proxies(issuer); err != nil {
+		return nil, fmt.Errorf("untrusted assertion issuer: %w", err)
+	}
+
+	leaf, err := v.verifyChain(tok, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if err := tok.Claims(leaf.PublicKey, claims); err != nil {
+		return nil, fmt.Errorf("invalid assertion signature: %w", err)
+	}
+
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      issuer.String(),
+		AnyAudience: jwt.Audience{v.audience},
+		Time:        time.Now(),
+	}, leeway)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Method != method || claims.Path != path {
+		return nil, fmt.Errorf(
+			"assertion is for %s %s, not %s %s",
+			claims.Method, claims.Path, method, path,
+		)
+	}
+
+	return claims, nil
+}
+
+// verifyChain checks that the x5c chain in the token is an X509-SVID for
+// issuer, and returns its leaf certificate.
+func (v *Verifier) verifyChain(tok *jwt.JSONWebToken, issuer spiffeid.ID) (*x509.Certificate, error) {
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("assertion must have exactly one signature")
+	}
+
+	bundle, err := v.bundles.GetX509BundleForTrustDomain(issuer.TrustDomain())
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	for _, authority := range bundle.X509Authorities() {
+		roots.AddCert(authority)
+	}
+
+	chains, err := tok.Headers[0].Certificates(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not verify assertion certificate: %w", err)
+	}
+
+	leaf := chains[0][0]
+	id, err := x509svid.IDFromCert(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != issuer {
+		return nil, fmt.Errorf("assertion certificate is for %s, not issuer %s", id, issuer)
+	}
+
+	return leaf, nil
+}
+
+// Middleware rejects requests without a valid assertion with a 401, and puts
+// the caller's SPIFFE ID in the context of those that have one.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(Header)
+		if token == "" {
+			http.Error(w, "missing identity assertion", http.StatusUnauthorized)
+
+			return
+		}
+
+		claims, err := v.Verify(token, r.Method, r.URL.Path)
+		if err != nil {
+			http.Error(w, "invalid identity assertion", http.StatusUnauthorized)
+
+			return
+		}
+
+		caller, err := claims.Caller()
+		if err != nil {
+			http.Error(w, "invalid identity assertion", http.StatusUnauthorized)
+
+			return
+		}
+
+		ctx := spiffeidutil.WithSPIFFEID(r.Context(), caller)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
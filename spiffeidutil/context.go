@@ -8,7 +8,19 @@ import (
 
 type ctxKey string
 
-const spidKey ctxKey = "spiffeid"
+const (
+	spidKey       ctxKey = "spiffeid"
+	authMethodKey ctxKey = "authmethod"
+)
+
+// AuthMethod describes how a caller's SPIFFE ID was authenticated.
+type AuthMethod string
+
+const (
+	AuthMethodNone AuthMethod = ""
+	AuthMethodX509 AuthMethod = "x509"
+	AuthMethodJWT  AuthMethod = "jwt"
+)
 
 func WithSPIFFEID(ctx context.Context, spID spiffeid.ID) context.Context {
 	return context.WithValue(ctx, spidKey, spID)
@@ -22,3 +34,16 @@ func FromContext(ctx context.Context) spiffeid.ID {
 
 	return spiffeid.ID{}
 }
+
+func WithAuthMethod(ctx context.Context, m AuthMethod) context.Context {
+	return context.WithValue(ctx, authMethodKey, m)
+}
+
+func AuthMethodFromContext(ctx context.Context) AuthMethod {
+	val := ctx.Value(authMethodKey)
+	if m, ok := val.(AuthMethod); ok {
+		return m
+	}
+
+	return AuthMethodNone
+}
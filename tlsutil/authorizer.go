@@ -0,0 +1,147 @@
+package tlsutil
+
+import (
+	"crypto/x509"
+	"fmt"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+)
+
+// Reasons a HandshakeAuthorizer rejects a client SVID, used as metric labels.
+const (
+	ReasonTrustDomain = "trust_domain"
+	ReasonUnknownID   = "unknown_id"
+	ReasonDenied      = "denied"
+)
+
+type idSet interface {
+	HasSPIFFEID(spiffeid.ID) bool
+}
+
+type denier interface {
+	CheckDenied(spiffeid.ID, *x509.Certificate) error
+}
+
+// HandshakeAuthorizer decides whether a client SVID may complete the TLS
+// handshake at all. It is a coarse filter in front of the route-based
+// authorization that happens once a request arrives.
+type HandshakeAuthorizer struct {
+	trustDomains []spiffeid.TrustDomain
+	knownIDs     idSet
+	denyList     denier
+	rejections   *prometheus.CounterVec
+}
+
+func NewHandshakeAuthorizer(opts ...Option) *HandshakeAuthorizer {
+	c := &config{}
+	for _, opt := range opts {
+		opt.Apply(c)
+	}
+
+	h := &HandshakeAuthorizer{
+		trustDomains: c.trustDomains,
+		knownIDs:     c.knownIDs,
+		denyList:     c.denyList,
+	}
+
+	if c.metrics != nil {
+		h.rejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tls_handshake_rejected_count",
+			Help: "A counter of client SVIDs rejected during the TLS handshake.",
+		}, []string{"reason"})
+
+		c.metrics.MustRegister(h.rejections)
+	}
+
+	return h
+}
+
+// Authorize implements tlsconfig.Authorizer.
+func (h *HandshakeAuthorizer) Authorize(id spiffeid.ID, verifiedChains [][]*x509.Certificate) error {
+	if h.denyList != nil {
+		var leaf *x509.Certificate
+		if len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+			leaf = verifiedChains[0][0]
+		}
+
+		if err := h.denyList.CheckDenied(id, leaf); err != nil {
+			h.reject(ReasonDenied)
+
+			return err
+		}
+	}
+
+	if len(h.trustDomains) > 0 && !slices.Contains(h.trustDomains, id.TrustDomain()) {
+		h.reject(ReasonTrustDomain)
+
+		return fmt.Errorf("trust domain %s is not allowed", id.TrustDomain())
+	}
+
+	if h.knownIDs != nil && !h.knownIDs.HasSPIFFEID(id) {
+		h.reject(ReasonUnknownID)
+
+		return fmt.Errorf("spiffeid %s does not appear in the policy", id)
+	}
+
+	return nil
+}
+
+// TLSAuthorizer adapts h for use with the tlsconfig package.
+func (h *HandshakeAuthorizer) TLSAuthorizer() tlsconfig.Authorizer {
+	return h.Authorize
+}
+
+func (h *HandshakeAuthorizer) reject(reason string) {
+	if h.rejections != nil {
+		h.rejections.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+}
+
+type config struct {
+	trustDomains []spiffeid.TrustDomain
+	knownIDs     idSet
+	denyList     denier
+	metrics      prometheus.Registerer
+}
+
+type Option interface {
+	Apply(*config)
+}
+
+type optionFunc func(*config)
+
+func (o optionFunc) Apply(c *config) {
+	o(c)
+}
+
+// WithTrustDomains limits client SVIDs to the given trust domains. With no
+// trust domains, any trust domain in the bundle is allowed.
+func WithTrustDomains(tds ...spiffeid.TrustDomain) Option {
+	return optionFunc(func(c *config) {
+		c.trustDomains = append(c.trustDomains, tds...)
+	})
+}
+
+// WithKnownIDs limits client SVIDs to those that s reports as known, such as
+// the SPIFFE IDs that appear in the authorization policy.
+func WithKnownIDs(s idSet) Option {
+	return optionFunc(func(c *config) {
+		c.knownIDs = s
+	})
+}
+
+// WithDenyList rejects client SVIDs that d reports as denied.
+func WithDenyList(d denier) Option {
+	return optionFunc(func(c *config) {
+		c.denyList = d
+	})
+}
+
+func WithMetrics(r prometheus.Registerer) Option {
+	return optionFunc(func(c *config) {
+		c.metrics = r
+	})
+}
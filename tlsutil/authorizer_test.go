@@ -0,0 +1,97 @@
+package tlsutil_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/tlsutil"
+)
+
+type denyIDs []spiffeid.ID
+
+func (d denyIDs) CheckDenied(id spiffeid.ID, _ *x509.Certificate) error {
+	if slices.Contains(d, id) {
+		return errors.New("denied")
+	}
+
+	return nil
+}
+
+type knownIDs []spiffeid.ID
+
+func (k knownIDs) HasSPIFFEID(id spiffeid.ID) bool {
+	return slices.Contains(k, id)
+}
+
+func TestHandshakeAuthorizer(t *testing.T) {
+	local := spiffeid.RequireFromString("spiffe://example.org/workload")
+	unknown := spiffeid.RequireFromString("spiffe://example.org/unknown")
+	partner := spiffeid.RequireFromString("spiffe://partner.example/workload")
+	other := spiffeid.RequireFromString("spiffe://other.example/workload")
+
+	t.Run("allows anything by default", func(t *testing.T) {
+		h := tlsutil.NewHandshakeAuthorizer()
+
+		require.NoError(t, h.Authorize(local, nil))
+		require.NoError(t, h.Authorize(other, nil))
+	})
+
+	t.Run("trust domains", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := tlsutil.NewHandshakeAuthorizer(
+			tlsutil.WithTrustDomains(local.TrustDomain(), partner.TrustDomain()),
+			tlsutil.WithMetrics(reg),
+		)
+
+		require.NoError(t, h.Authorize(local, nil))
+		require.NoError(t, h.Authorize(partner, nil))
+		require.Error(t, h.Authorize(other, nil))
+
+		count, err := testutil.GatherAndCount(reg, "tls_handshake_rejected_count")
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("known ids", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := tlsutil.NewHandshakeAuthorizer(
+			tlsutil.WithKnownIDs(knownIDs{local}),
+			tlsutil.WithMetrics(reg),
+		)
+
+		require.NoError(t, h.Authorize(local, nil))
+		require.Error(t, h.Authorize(unknown, nil))
+		require.Error(t, h.Authorize(other, nil))
+
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		require.Len(t, mfs, 1)
+		require.Len(t, mfs[0].GetMetric(), 1)
+		assert.Equal(t, tlsutil.ReasonUnknownID, mfs[0].GetMetric()[0].GetLabel()[0].GetValue())
+		assert.InDelta(t, 2.0, mfs[0].GetMetric()[0].GetCounter().GetValue(), 0)
+	})
+
+	t.Run("deny list", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		h := tlsutil.NewHandshakeAuthorizer(
+			tlsutil.WithDenyList(denyIDs{unknown}),
+			tlsutil.WithMetrics(reg),
+		)
+
+		require.NoError(t, h.Authorize(local, nil))
+		require.Error(t, h.Authorize(unknown, nil))
+
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		require.Len(t, mfs, 1)
+		assert.Equal(t, tlsutil.ReasonDenied, mfs[0].GetMetric()[0].GetLabel()[0].GetValue())
+	})
+}
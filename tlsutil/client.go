@@ -0,0 +1,34 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// UpstreamClientConfig returns a TLS configuration for connecting to an
+// upstream, presenting svid as the client certificate. With an authorizer,
+// the upstream must present an X509-SVID that verifies against bundle and
+// satisfies authorizer. Without one, the upstream is verified with Web PKI
+// against roots, or the system roots if roots is nil, and serverName. Either
+// way, serverName is sent as the SNI.
+func UpstreamClientConfig(
+	svid x509svid.Source,
+	bundle x509bundle.Source,
+	authorizer tlsconfig.Authorizer,
+	roots *x509.CertPool,
+	serverName string,
+) *tls.Config {
+	var cfg *tls.Config
+	if authorizer != nil {
+		cfg = tlsconfig.MTLSClientConfig(svid, bundle, authorizer)
+	} else {
+		cfg = tlsconfig.MTLSWebClientConfig(svid, roots)
+	}
+	cfg.ServerName = serverName
+
+	return cfg
+}
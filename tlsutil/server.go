@@ -0,0 +1,37 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+)
+
+// OptionalMTLSServerConfig returns a TLS configuration like
+// tlsconfig.MTLSServerConfig, except that it requests, rather than requires,
+// a client X509-SVID. Any certificate that the client does present is still
+// verified and authorized, so a handshake with an invalid SVID fails, but a
+// handshake without one succeeds and it is up to the handler to decide what
+// unauthenticated callers can reach.
+func OptionalMTLSServerConfig(
+	svid x509svid.Source,
+	bundle x509bundle.Source,
+	authorizer tlsconfig.Authorizer,
+	opts ...tlsconfig.Option,
+) *tls.Config {
+	cfg := tlsconfig.MTLSServerConfig(svid, bundle, authorizer, opts...)
+	verify := cfg.VerifyPeerCertificate
+
+	cfg.ClientAuth = tls.RequestClientCert
+	cfg.VerifyPeerCertificate = func(raw [][]byte, chains [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return nil
+		}
+
+		return verify(raw, chains)
+	}
+
+	return cfg
+}
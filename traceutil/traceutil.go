@@ -0,0 +1,82 @@
+// Package traceutil carries the trace ID of a request, from its W3C
+// traceparent header, so that metrics can link to the trace with exemplars.
+package traceutil
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TraceParentHeader is the W3C Trace Context header.
+const TraceParentHeader = "Traceparent"
+
+// ExemplarLabel is the label that holds the trace ID in exemplars.
+const ExemplarLabel = "trace_id"
+
+type traceIDKey struct{}
+
+// WithTraceID adds a trace ID to the context.
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceIDFromContext returns the trace ID in the context, or "" if there
+// isn't one.
+func TraceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+
+	return id
+}
+
+// TraceIDFromHeader returns the trace ID of a valid traceparent header in h,
+// or "" if there isn't one.
+func TraceIDFromHeader(h http.Header) string {
+	// version-traceid-parentid-flags, like
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	parts := strings.Split(strings.TrimSpace(h.Get(TraceParentHeader)), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ""
+	}
+
+	id := parts[1]
+	if len(id) != 32 || !isLowerHex(id) || strings.Trim(id, "0") == "" {
+		return ""
+	}
+
+	return id
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if ('0' > c || c > '9') && ('a' > c || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handler adds the trace ID of each request's traceparent header, if it has
+// one, to the request's context.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := TraceIDFromHeader(r.Header); id != "" {
+			r = r.WithContext(WithTraceID(r.Context(), id))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Exemplar returns exemplar labels with the trace ID in ctx, or nil if there
+// isn't one, for promhttp.WithExemplarFromContext.
+func Exemplar(ctx context.Context) prometheus.Labels {
+	if id := TraceIDFromContext(ctx); id != "" {
+		return prometheus.Labels{ExemplarLabel: id}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package traceutil_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"jsocol.io/spiffe-authz-proxy/traceutil"
+)
+
+func TestTraceIDFromHeader(t *testing.T) {
+	tests := map[string]struct {
+		header string
+		id     string
+	}{
+		"valid": {
+			header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			id:     "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		"future version": {
+			header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			id:     "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		"missing":         {},
+		"invalid version": {header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"zero trace ID":   {header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		"uppercase":       {header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		"short":           {header: "00-4bf92f35-00f067aa0ba902b7-01"},
+		"garbage":         {header: "not a traceparent"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := http.Header{}
+			if tc.header != "" {
+				h.Set(traceutil.TraceParentHeader, tc.header)
+			}
+
+			assert.Equal(t, tc.id, traceutil.TraceIDFromHeader(h))
+		})
+	}
+}
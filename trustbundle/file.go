@@ -0,0 +1,89 @@
+package trustbundle
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+type hclFederatesWith struct {
+	TrustDomain     string `hcl:"name,label"`
+	URL             string `hcl:"bundle_endpoint_url"`
+	Profile         string `hcl:"bundle_endpoint_profile"`
+	EndpointID      string `hcl:"endpoint_spiffe_id,optional"`
+	RootCAsFile     string `hcl:"root_cas_file,optional"`
+	BootstrapBundle string `hcl:"bootstrap_bundle_file,optional"`
+}
+
+type hclConfig struct {
+	FederatesWith []hclFederatesWith `hcl:"federates_with,block"`
+}
+
+// FromFile reads federated bundle endpoints from an HCL or JSON file.
+func FromFile(fileName string) ([]Endpoint, error) {
+	cfg := &hclConfig{}
+	if err := hclsimple.DecodeFile(fileName, nil, cfg); err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]Endpoint, 0, len(cfg.FederatesWith))
+	for _, fw := range cfg.FederatesWith {
+		ep, err := fw.toEndpoint()
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, ep)
+	}
+
+	return endpoints, nil
+}
+
+func (h *hclFederatesWith) toEndpoint() (Endpoint, error) {
+	td, err := spiffeid.TrustDomainFromString(h.TrustDomain)
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	ep := Endpoint{
+		TrustDomain: td,
+		URL:         h.URL,
+		Profile:     h.Profile,
+	}
+
+	switch h.Profile {
+	case ProfileHTTPSSPIFFE:
+		ep.EndpointID, err = spiffeid.FromString(h.EndpointID)
+		if err != nil {
+			return Endpoint{}, fmt.Errorf("invalid endpoint_spiffe_id for %s: %w", td, err)
+		}
+	case ProfileHTTPSWeb:
+	default:
+		return Endpoint{}, fmt.Errorf("unsupported bundle_endpoint_profile %q for %s", h.Profile, td)
+	}
+
+	if h.RootCAsFile != "" {
+		// ignore gosec G304, this is on purpose
+		pemBytes, err := os.ReadFile(h.RootCAsFile) //nolint:gosec
+		if err != nil {
+			return Endpoint{}, err
+		}
+
+		ep.RootCAs = x509.NewCertPool()
+		if !ep.RootCAs.AppendCertsFromPEM(pemBytes) {
+			return Endpoint{}, fmt.Errorf("no certificates found in %s", h.RootCAsFile)
+		}
+	}
+
+	if h.BootstrapBundle != "" {
+		ep.Bootstrap, err = x509bundle.Load(td, h.BootstrapBundle)
+		if err != nil {
+			return Endpoint{}, err
+		}
+	}
+
+	return ep, nil
+}
@@ -0,0 +1,207 @@
+package trustbundle
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/federation"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// Bundle endpoint profiles, as described in the SPIFFE Federation spec.
+const (
+	ProfileHTTPSSPIFFE = "https_spiffe"
+	ProfileHTTPSWeb    = "https_web"
+)
+
+const defaultRefreshInterval = 5 * time.Minute
+
+var _ x509bundle.Source = (*Source)(nil)
+
+// Endpoint is the SPIFFE bundle endpoint for a federated trust domain.
+type Endpoint struct {
+	TrustDomain spiffeid.TrustDomain
+	URL         string
+	Profile     string
+	// EndpointID is the SPIFFE ID the endpoint must present. It is only used
+	// with ProfileHTTPSSPIFFE.
+	EndpointID spiffeid.ID
+	// RootCAs, if set, replace the system roots when authenticating an
+	// endpoint with ProfileHTTPSWeb.
+	RootCAs *x509.CertPool
+	// Bootstrap, if set, is used until the first bundle has been fetched. It
+	// is needed to authenticate an endpoint with ProfileHTTPSSPIFFE that the
+	// local source does not already have a bundle for.
+	Bootstrap *x509bundle.Bundle
+}
+
+// Source is an x509bundle.Source that merges bundles fetched from federated
+// bundle endpoints with those from a local source, typically the Workload
+// API. Fetched bundles take precedence for the trust domains they cover.
+type Source struct {
+	local     x509bundle.Source
+	endpoints []Endpoint
+	logger    *slog.Logger
+	refresh   time.Duration
+
+	mu      sync.RWMutex
+	bundles map[spiffeid.TrustDomain]*x509bundle.Bundle
+}
+
+func New(local x509bundle.Source, endpoints []Endpoint, opts ...Option) *Source {
+	c := &config{
+		logger:  slog.Default(),
+		refresh: defaultRefreshInterval,
+	}
+	for _, opt := range opts {
+		opt.Apply(c)
+	}
+
+	s := &Source{
+		local:     local,
+		endpoints: endpoints,
+		logger:    c.logger,
+		refresh:   c.refresh,
+		bundles:   make(map[spiffeid.TrustDomain]*x509bundle.Bundle, len(endpoints)),
+	}
+
+	for _, ep := range endpoints {
+		if ep.Bootstrap != nil {
+			s.bundles[ep.TrustDomain] = ep.Bootstrap
+		}
+	}
+
+	return s
+}
+
+func (s *Source) GetX509BundleForTrustDomain(td spiffeid.TrustDomain) (*x509bundle.Bundle, error) {
+	s.mu.RLock()
+	b, ok := s.bundles[td]
+	s.mu.RUnlock()
+
+	if ok {
+		return b, nil
+	}
+
+	if s.local == nil {
+		return nil, fmt.Errorf("no bundle for trust domain %s", td)
+	}
+
+	return s.local.GetX509BundleForTrustDomain(td)
+}
+
+// Run fetches and refreshes the bundle of every endpoint until ctx is done.
+func (s *Source) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, ep := range s.endpoints {
+		opts, err := s.fetchOptions(ep)
+		if err != nil {
+			return err
+		}
+
+		wg.Go(func() {
+			w := &watcher{source: s, endpoint: ep}
+			err := federation.WatchBundle(ctx, ep.TrustDomain, ep.URL, w, opts...)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				s.logger.ErrorContext(ctx, "stopped watching bundle endpoint",
+					"trustDomain", ep.TrustDomain.String(),
+					"error", err,
+				)
+			}
+		})
+	}
+
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func (s *Source) fetchOptions(ep Endpoint) ([]federation.FetchOption, error) {
+	switch ep.Profile {
+	case ProfileHTTPSSPIFFE:
+		if ep.EndpointID.IsZero() {
+			return nil, fmt.Errorf("endpoint for %s needs an endpoint SPIFFE ID", ep.TrustDomain)
+		}
+
+		return []federation.FetchOption{federation.WithSPIFFEAuth(s, ep.EndpointID)}, nil
+	case ProfileHTTPSWeb:
+		if ep.RootCAs != nil {
+			return []federation.FetchOption{federation.WithWebPKIRoots(ep.RootCAs)}, nil
+		}
+
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported bundle endpoint profile %q for %s", ep.Profile, ep.TrustDomain)
+	}
+}
+
+func (s *Source) set(td spiffeid.TrustDomain, b *x509bundle.Bundle) {
+	s.mu.Lock()
+	s.bundles[td] = b
+	s.mu.Unlock()
+}
+
+type watcher struct {
+	source   *Source
+	endpoint Endpoint
+}
+
+func (w *watcher) NextRefresh(hint time.Duration) time.Duration {
+	if hint > 0 && hint < w.source.refresh {
+		return hint
+	}
+
+	return w.source.refresh
+}
+
+func (w *watcher) OnUpdate(b *spiffebundle.Bundle) {
+	w.source.set(w.endpoint.TrustDomain, b.X509Bundle())
+	w.source.logger.Info("updated federated bundle",
+		"trustDomain", w.endpoint.TrustDomain.String(),
+		"authorities", len(b.X509Authorities()),
+	)
+}
+
+func (w *watcher) OnError(err error) {
+	w.source.logger.Warn("could not fetch federated bundle",
+		"trustDomain", w.endpoint.TrustDomain.String(),
+		"url", w.endpoint.URL,
+		"error", err,
+	)
+}
+
+type config struct {
+	logger  *slog.Logger
+	refresh time.Duration
+}
+
+type Option interface {
+	Apply(*config)
+}
+
+type optionFunc func(*config)
+
+func (o optionFunc) Apply(c *config) {
+	o(c)
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return optionFunc(func(c *config) {
+		c.logger = l
+	})
+}
+
+// WithRefreshInterval sets how often bundles are refreshed when the endpoint
+// does not provide a shorter refresh hint.
+func WithRefreshInterval(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.refresh = d
+	})
+}
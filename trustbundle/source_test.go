@@ -0,0 +1,138 @@
+package trustbundle_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/federation"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/trustbundle"
+)
+
+func TestSource_HTTPSWeb(t *testing.T) {
+	partnerTD := spiffeid.RequireTrustDomainFromString("partner.example")
+	localTD := spiffeid.RequireTrustDomainFromString("example.org")
+
+	partnerCA := newTestCA(t, "partner")
+	localCA := newTestCA(t, "local")
+
+	endpoint := httptest.NewUnstartedServer(nil)
+	handler, err := federation.NewHandler(
+		partnerTD,
+		spiffebundle.FromX509Authorities(partnerTD, []*x509.Certificate{partnerCA}),
+	)
+	require.NoError(t, err)
+	endpoint.Config.Handler = handler
+	endpoint.StartTLS()
+	defer endpoint.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(endpoint.Certificate())
+
+	local := x509bundle.FromX509Authorities(localTD, []*x509.Certificate{localCA})
+	source := trustbundle.New(local, []trustbundle.Endpoint{
+		{
+			TrustDomain: partnerTD,
+			URL:         endpoint.URL,
+			Profile:     trustbundle.ProfileHTTPSWeb,
+			RootCAs:     roots,
+		},
+	})
+
+	_, err = source.GetX509BundleForTrustDomain(partnerTD)
+	require.Error(t, err, "partner bundle is not available before it is fetched")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- source.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := source.GetX509BundleForTrustDomain(partnerTD)
+
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	partner, err := source.GetX509BundleForTrustDomain(partnerTD)
+	require.NoError(t, err)
+	assert.True(t, partner.HasX509Authority(partnerCA))
+
+	fromLocal, err := source.GetX509BundleForTrustDomain(localTD)
+	require.NoError(t, err)
+	assert.True(t, fromLocal.HasX509Authority(localCA))
+
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestSource_Bootstrap(t *testing.T) {
+	partnerTD := spiffeid.RequireTrustDomainFromString("partner.example")
+	bootstrap := x509bundle.FromX509Authorities(partnerTD, []*x509.Certificate{newTestCA(t, "partner")})
+
+	source := trustbundle.New(nil, []trustbundle.Endpoint{
+		{
+			TrustDomain: partnerTD,
+			URL:         "https://unused.example",
+			Profile:     trustbundle.ProfileHTTPSSPIFFE,
+			EndpointID:  spiffeid.RequireFromString("spiffe://partner.example/spire/server"),
+			Bootstrap:   bootstrap,
+		},
+	})
+
+	b, err := source.GetX509BundleForTrustDomain(partnerTD)
+	require.NoError(t, err)
+	assert.Equal(t, bootstrap, b)
+}
+
+func TestFromFile(t *testing.T) {
+	endpoints, err := trustbundle.FromFile("testdata/federation.hcl")
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+
+	assert.Equal(t, "partner.example", endpoints[0].TrustDomain.Name())
+	assert.Equal(t, trustbundle.ProfileHTTPSSPIFFE, endpoints[0].Profile)
+	assert.Equal(t, "spiffe://partner.example/spire/server", endpoints[0].EndpointID.String())
+
+	assert.Equal(t, "web.example", endpoints[1].TrustDomain.Name())
+	assert.Equal(t, trustbundle.ProfileHTTPSWeb, endpoints[1].Profile)
+	assert.Equal(t, "https://web.example/bundle.json", endpoints[1].URL)
+}
+
+func newTestCA(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert
+}
@@ -0,0 +1,10 @@
+federates_with "partner.example" {
+  bundle_endpoint_url     = "https://spire.partner.example:8443"
+  bundle_endpoint_profile = "https_spiffe"
+  endpoint_spiffe_id      = "spiffe://partner.example/spire/server"
+}
+
+federates_with "web.example" {
+  bundle_endpoint_url     = "https://web.example/bundle.json"
+  bundle_endpoint_profile = "https_web"
+}
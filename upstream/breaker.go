@@ -0,0 +1,306 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultBreakerWindow           = 10 * time.Second
+	defaultBreakerMinRequests      = 20
+	defaultBreakerErrorRate        = 0.5
+	defaultBreakerSlowRate         = 0.5
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 3
+)
+
+// CircuitBreaker configures a circuit breaker in front of the upstream.
+// While closed, it trips open once at least MinRequests requests within a
+// Window have an ErrorRate of failures, meaning connection errors or 5xx
+// responses, or, if SlowRequest is set, a SlowRate of responses slower than
+// SlowRequest. While open, requests are answered immediately with a 503 and
+// a Retry-After header. After OpenDuration, it lets HalfOpenRequests through
+// and closes if they all succeed, or opens again if any fail. Zero values are
+// replaced with defaults.
+type CircuitBreaker struct {
+	Window           time.Duration
+	MinRequests      int
+	ErrorRate        float64
+	SlowRequest      time.Duration
+	SlowRate         float64
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+func (cb CircuitBreaker) withDefaults() CircuitBreaker {
+	if cb.Window <= 0 {
+		cb.Window = defaultBreakerWindow
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = defaultBreakerMinRequests
+	}
+	if cb.ErrorRate <= 0 {
+		cb.ErrorRate = defaultBreakerErrorRate
+	}
+	if cb.SlowRate <= 0 {
+		cb.SlowRate = defaultBreakerSlowRate
+	}
+	if cb.OpenDuration <= 0 {
+		cb.OpenDuration = defaultBreakerOpenDuration
+	}
+	if cb.HalfOpenRequests <= 0 {
+		cb.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+
+	return cb
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half_open"
+)
+
+// circuitOpenError is returned by the breaker's RoundTrip while it is open.
+// Upstream.Proxy turns it into a 503 response.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker is open, retry after %s", e.retryAfter)
+}
+
+func (e *circuitOpenError) response(req *http.Request) *http.Response {
+	seconds := max(1, int(math.Ceil(e.retryAfter.Seconds())))
+	body := "upstream unavailable\n"
+
+	return &http.Response{
+		Status:     "503 Service Unavailable",
+		StatusCode: http.StatusServiceUnavailable,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": {"text/plain; charset=utf-8"},
+			"Retry-After":  {strconv.Itoa(seconds)},
+		},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+type breaker struct {
+	policy CircuitBreaker
+	next   http.RoundTripper
+	now    func() time.Time
+
+	mu    sync.Mutex
+	state breakerState
+	// The counts of requests, failures, and slow requests since
+	// windowStart, while closed.
+	windowStart time.Time
+	requests    int
+	failures    int
+	slow        int
+	// openedAt is when the breaker last opened.
+	openedAt time.Time
+	// probes is the number of requests let through while half-open, and
+	// probeSuccesses the number of those that succeeded.
+	probes         int
+	probeSuccesses int
+
+	states      *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+}
+
+func newBreaker(cb CircuitBreaker, next http.RoundTripper) *breaker {
+	b := &breaker{
+		policy: cb.withDefaults(),
+		next:   next,
+		now:    time.Now,
+		state:  breakerClosed,
+	}
+	b.windowStart = b.now()
+
+	return b
+}
+
+func (b *breaker) collectors() []prometheus.Collector {
+	b.states = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_circuit_breaker_state",
+		Help: "The state of the upstream circuit breaker, 1 for the current state and 0 for the others.",
+	}, []string{"state"})
+	b.transitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_circuit_breaker_transition_count",
+		Help: "A counter of upstream circuit breaker state changes, by the new state.",
+	}, []string{"state"})
+
+	for _, s := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+		b.states.With(prometheus.Labels{"state": string(s)})
+		b.transitions.With(prometheus.Labels{"state": string(s)})
+	}
+	b.states.With(prometheus.Labels{"state": string(b.state)}).Set(1)
+
+	return []prometheus.Collector{b.states, b.transitions}
+}
+
+func (b *breaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	probe, err := b.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	start := b.now()
+	resp, err := b.next.RoundTrip(req)
+	elapsed := b.now().Sub(start)
+
+	// A caller that gave up says nothing about the upstream.
+	if req.Context().Err() != nil {
+		b.release(probe)
+
+		return resp, err
+	}
+
+	ok := err == nil && resp.StatusCode < http.StatusInternalServerError
+	slow := b.policy.SlowRequest > 0 && elapsed > b.policy.SlowRequest
+	b.record(probe, ok, slow)
+
+	return resp, err
+}
+
+// allow reports whether a request may be sent, and whether it is one of the
+// requests let through while half-open.
+func (b *breaker) allow() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.state == breakerOpen {
+		remaining := b.policy.OpenDuration - now.Sub(b.openedAt)
+		if remaining > 0 {
+			return false, &circuitOpenError{retryAfter: remaining}
+		}
+
+		b.transition(breakerHalfOpen, now)
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.probes >= b.policy.HalfOpenRequests {
+			return false, &circuitOpenError{retryAfter: time.Second}
+		}
+		b.probes++
+
+		return true, nil
+	}
+
+	if now.Sub(b.windowStart) >= b.policy.Window {
+		b.resetWindow(now)
+	}
+
+	return false, nil
+}
+
+func (b *breaker) release(probe bool) {
+	if !probe {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probes--
+	}
+}
+
+func (b *breaker) record(probe, ok, slow bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	switch b.state {
+	case breakerHalfOpen:
+		if !probe {
+			return
+		}
+
+		if !ok || slow {
+			b.transition(breakerOpen, now)
+
+			return
+		}
+
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.policy.HalfOpenRequests {
+			b.transition(breakerClosed, now)
+		}
+	case breakerClosed:
+		b.requests++
+		if !ok {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+
+		if b.requests < b.policy.MinRequests {
+			return
+		}
+
+		total := float64(b.requests)
+		if float64(b.failures)/total >= b.policy.ErrorRate ||
+			(b.policy.SlowRequest > 0 && float64(b.slow)/total >= b.policy.SlowRate) {
+			b.transition(breakerOpen, now)
+		}
+	case breakerOpen:
+		// Requests sent before the breaker opened don't change anything.
+	}
+}
+
+// transition changes the state. b.mu must be held.
+func (b *breaker) transition(to breakerState, now time.Time) {
+	if b.states != nil {
+		b.states.With(prometheus.Labels{"state": string(b.state)}).Set(0)
+		b.states.With(prometheus.Labels{"state": string(to)}).Set(1)
+		b.transitions.With(prometheus.Labels{"state": string(to)}).Inc()
+	}
+
+	b.state = to
+	b.probes = 0
+	b.probeSuccesses = 0
+
+	switch to {
+	case breakerOpen:
+		b.openedAt = now
+	case breakerClosed:
+		b.resetWindow(now)
+	case breakerHalfOpen:
+	}
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+	b.slow = 0
+}
+
+func isCircuitOpen(err error) (*circuitOpenError, bool) {
+	var open *circuitOpenError
+	ok := errors.As(err, &open)
+
+	return open, ok
+}
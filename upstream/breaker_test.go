@@ -0,0 +1,137 @@
+package upstream_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+func proxyStatus(t *testing.T, up *upstream.Upstream) *http.Response {
+	t.Helper()
+
+	resp, err := up.Proxy(newRequest(t))
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, resp.Body.Close())
+
+	return resp
+}
+
+func TestCircuitBreaker_ErrorRate(t *testing.T) {
+	var failing atomic.Bool
+	var calls atomic.Int32
+	failing.Store(true)
+	backend := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithCircuitBreaker(upstream.CircuitBreaker{
+			MinRequests:      4,
+			ErrorRate:        0.5,
+			OpenDuration:     100 * time.Millisecond,
+			HalfOpenRequests: 1,
+		}),
+		upstream.WithMetrics(reg),
+	)
+	require.NoError(t, err)
+
+	for range 4 {
+		assert.Equal(t, http.StatusInternalServerError, proxyStatus(t, up).StatusCode)
+	}
+
+	resp := proxyStatus(t, up)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Equal(t, int32(4), calls.Load(), "an open breaker doesn't reach the upstream")
+
+	failing.Store(false)
+	time.Sleep(150 * time.Millisecond)
+
+	assert.Equal(t, http.StatusOK, proxyStatus(t, up).StatusCode)
+	assert.Equal(t, http.StatusOK, proxyStatus(t, up).StatusCode)
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP upstream_circuit_breaker_state The state of the upstream circuit breaker, 1 for the current state and 0 for the others.
+# TYPE upstream_circuit_breaker_state gauge
+upstream_circuit_breaker_state{state="closed"} 1
+upstream_circuit_breaker_state{state="half_open"} 0
+upstream_circuit_breaker_state{state="open"} 0
+# HELP upstream_circuit_breaker_transition_count A counter of upstream circuit breaker state changes, by the new state.
+# TYPE upstream_circuit_breaker_transition_count counter
+upstream_circuit_breaker_transition_count{state="closed"} 1
+upstream_circuit_breaker_transition_count{state="half_open"} 1
+upstream_circuit_breaker_transition_count{state="open"} 1
+`), "upstream_circuit_breaker_state", "upstream_circuit_breaker_transition_count")
+	require.NoError(t, err)
+}
+
+func TestCircuitBreaker_HalfOpenFailure(t *testing.T) {
+	var calls atomic.Int32
+	backend := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithCircuitBreaker(upstream.CircuitBreaker{
+			MinRequests:      2,
+			OpenDuration:     50 * time.Millisecond,
+			HalfOpenRequests: 1,
+		}),
+	)
+	require.NoError(t, err)
+
+	proxyStatus(t, up)
+	proxyStatus(t, up)
+	assert.Equal(t, http.StatusServiceUnavailable, proxyStatus(t, up).StatusCode)
+
+	time.Sleep(75 * time.Millisecond)
+
+	// The probe fails, so the breaker opens again.
+	assert.Equal(t, http.StatusBadGateway, proxyStatus(t, up).StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, proxyStatus(t, up).StatusCode)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestCircuitBreaker_Latency(t *testing.T) {
+	backend := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithCircuitBreaker(upstream.CircuitBreaker{
+			MinRequests: 2,
+			SlowRequest: 10 * time.Millisecond,
+		}),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, proxyStatus(t, up).StatusCode)
+	assert.Equal(t, http.StatusOK, proxyStatus(t, up).StatusCode)
+
+	resp := proxyStatus(t, up)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+}
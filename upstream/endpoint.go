@@ -0,0 +1,209 @@
+package upstream
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer selects which endpoint receives each request.
+type Balancer string
+
+const (
+	// RoundRobin sends requests to each healthy endpoint in turn.
+	RoundRobin Balancer = "round_robin"
+	// LeastRequest sends each request to the healthy endpoint with the
+	// fewest requests in flight.
+	LeastRequest Balancer = "least_request"
+)
+
+// ParseBalancer parses a Balancer. An empty string is RoundRobin.
+func ParseBalancer(s string) (Balancer, error) {
+	switch Balancer(s) {
+	case "", RoundRobin:
+		return RoundRobin, nil
+	case LeastRequest:
+		return LeastRequest, nil
+	default:
+		return "", fmt.Errorf("unsupported balancer %q", s)
+	}
+}
+
+// endpoint is one address of an upstream. Requests are sent with key as
+// their host, so that the transport pools connections per endpoint and its
+// DialContext hook knows which address to dial. host is the endpoint's real
+// authority, which health checks send as their Host header, and serverName,
+// if set, is the name to send and verify during a TLS handshake.
+type endpoint struct {
+	addr       net.Addr
+	key        string
+	host       string
+	serverName string
+	inflight   atomic.Int64
+
+	mu sync.Mutex
+	// healthy is the result of active health checks, and checkSuccesses
+	// and checkFailures count consecutive results that disagree with it.
+	healthy        bool
+	checkSuccesses int
+	checkFailures  int
+	// failures counts consecutive failed requests, for passive health
+	// checks, and the endpoint is skipped until ejectedUntil.
+	failures     int
+	ejectedUntil time.Time
+}
+
+// endpointAddr is the address of an endpoint, and the authority it was
+// configured with, if any.
+type endpointAddr struct {
+	addr net.Addr
+	host string
+}
+
+func newEndpoints(addrs []endpointAddr) ([]*endpoint, error) {
+	seen := make(map[string]bool, len(addrs))
+	endpoints := make([]*endpoint, 0, len(addrs))
+	for i, a := range addrs {
+		id := a.addr.Network() + ":" + a.addr.String()
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate upstream endpoint %s", a.addr.String())
+		}
+		seen[id] = true
+
+		ep := &endpoint{
+			addr:    a.addr,
+			key:     fmt.Sprintf("endpoint-%d", i),
+			host:    a.host,
+			healthy: true,
+		}
+		if a.host != "" {
+			ep.serverName = hostname(a.host)
+		} else {
+			ep.host = defaultHost(a.addr)
+		}
+		endpoints = append(endpoints, ep)
+	}
+
+	return endpoints, nil
+}
+
+// defaultHost is the authority of an endpoint that was configured without
+// one: its address if it's a TCP address, or localhost, for a Unix socket.
+func defaultHost(addr net.Addr) string {
+	if _, ok := addr.(*net.TCPAddr); ok {
+		return addr.String()
+	}
+
+	return "localhost"
+}
+
+// hostname strips the port from an authority, like "api.internal:8443".
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return strings.Trim(host, "[]")
+}
+
+func (e *endpoint) available(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.healthy && !now.Before(e.ejectedUntil)
+}
+
+// recordCheck records the result of an active health check and reports
+// whether the endpoint changed between healthy and unhealthy.
+func (e *endpoint) recordCheck(ok bool, hc *HealthCheck) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ok {
+		e.checkFailures = 0
+		if e.healthy {
+			return false
+		}
+
+		e.checkSuccesses++
+		if e.checkSuccesses >= hc.HealthyThreshold {
+			e.healthy = true
+			e.checkSuccesses = 0
+
+			return true
+		}
+
+		return false
+	}
+
+	e.checkSuccesses = 0
+	if !e.healthy {
+		return false
+	}
+
+	e.checkFailures++
+	if e.checkFailures >= hc.UnhealthyThreshold {
+		e.healthy = false
+		e.checkFailures = 0
+
+		return true
+	}
+
+	return false
+}
+
+// recordRequest records the outcome of a proxied request and reports whether
+// it caused the endpoint to be ejected.
+func (e *endpoint) recordRequest(ok bool, phc *PassiveHealthCheck, now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if ok {
+		e.failures = 0
+
+		return false
+	}
+
+	e.failures++
+	if e.failures >= phc.ConsecutiveFailures {
+		e.failures = 0
+		e.ejectedUntil = now.Add(phc.EjectionTime)
+
+		return true
+	}
+
+	return false
+}
+
+// trackedBody marks the request finished, for least-request balancing, and
+// releases its context once the response body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	defer b.done()
+
+	return b.ReadCloser.Close()
+}
+
+// trackedConn is a trackedBody for a 101 Switching Protocols response, whose
+// body is the connection to the upstream and can be written to.
+type trackedConn struct {
+	trackedBody
+	io.Writer
+}
+
+func newTrackedBody(body io.ReadCloser, done func()) io.ReadCloser {
+	tb := trackedBody{ReadCloser: body, done: done}
+	if w, ok := body.(io.Writer); ok {
+		return &trackedConn{trackedBody: tb, Writer: w}
+	}
+
+	return &tb
+}
@@ -0,0 +1,185 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+	defaultEjectionTime        = 30 * time.Second
+	defaultConsecutiveFailures = 5
+)
+
+// HealthCheck configures active health checks, which request Path from
+// every endpoint each Interval. An endpoint is taken out of rotation after
+// UnhealthyThreshold consecutive failed checks, and put back after
+// HealthyThreshold consecutive successful ones. Any 2xx or 3xx response is a
+// success. Zero values are replaced with defaults.
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+func (hc HealthCheck) withDefaults() *HealthCheck {
+	if hc.Path == "" {
+		hc.Path = "/"
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = defaultHealthCheckInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultHealthCheckTimeout
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = defaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	return &hc
+}
+
+// PassiveHealthCheck configures passive health checks, which eject an
+// endpoint for EjectionTime after ConsecutiveFailures proxied requests in a
+// row fail to connect or receive a 5xx response. Zero values are replaced
+// with defaults.
+type PassiveHealthCheck struct {
+	ConsecutiveFailures int
+	EjectionTime        time.Duration
+}
+
+func (phc PassiveHealthCheck) withDefaults() *PassiveHealthCheck {
+	if phc.ConsecutiveFailures <= 0 {
+		phc.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+	if phc.EjectionTime <= 0 {
+		phc.EjectionTime = defaultEjectionTime
+	}
+
+	return &phc
+}
+
+// Run actively checks the health of every endpoint until ctx is done. It
+// returns immediately if the upstream has no health check.
+func (u *Upstream) Run(ctx context.Context) error {
+	if u.healthCheck == nil {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, ep := range u.endpoints {
+		wg.Go(func() {
+			ticker := time.NewTicker(u.healthCheck.Interval)
+			defer ticker.Stop()
+
+			for {
+				u.check(ctx, ep)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		})
+	}
+
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// Check returns an error unless one of the endpoints that health checks
+// haven't taken out of rotation accepts a connection. It doesn't send a
+// request, and the connection isn't reused.
+func (u *Upstream) Check(ctx context.Context) error {
+	var errs []error
+	now := time.Now()
+	for _, ep := range u.endpoints {
+		if !ep.available(now) {
+			continue
+		}
+
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, ep.addr.Network(), ep.addr.String())
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+		_ = conn.Close()
+
+		return nil
+	}
+
+	if len(errs) == 0 {
+		return ErrNoHealthyEndpoints
+	}
+
+	return fmt.Errorf("could not reach upstream: %w", errors.Join(errs...))
+}
+
+func (u *Upstream) check(ctx context.Context, ep *endpoint) {
+	ctx, cancel := context.WithTimeout(ctx, u.healthCheck.Timeout)
+	defer cancel()
+
+	ok := false
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		u.scheme+"://"+ep.key+u.healthCheck.Path,
+		http.NoBody,
+	)
+	if err == nil {
+		req.Host = ep.host
+
+		var resp *http.Response
+		resp, err = u.transport.RoundTrip(req)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			ok = resp.StatusCode >= 200 && resp.StatusCode < 400
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	if ep.recordCheck(ok, u.healthCheck) {
+		if ok {
+			u.logger.InfoContext(ctx, "upstream endpoint is healthy", "endpoint", ep.addr.String())
+		} else {
+			u.logger.WarnContext(ctx, "upstream endpoint is unhealthy", "endpoint", ep.addr.String(), "error", err)
+		}
+	}
+}
+
+// observe records the outcome of a proxied request for passive health checks.
+func (u *Upstream) observe(ctx context.Context, ep *endpoint, resp *http.Response, err error) {
+	if u.passiveHealthCheck == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	ok := err == nil && resp.StatusCode < http.StatusInternalServerError
+	if ep.recordRequest(ok, u.passiveHealthCheck, time.Now()) {
+		u.logger.WarnContext(ctx, "ejected upstream endpoint",
+			"endpoint", ep.addr.String(),
+			"ejectionTime", u.passiveHealthCheck.EjectionTime,
+		)
+	}
+}
@@ -0,0 +1,127 @@
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMaxIdlePerEndpoint = 32
+	defaultIdleTimeout        = 90 * time.Second
+	defaultKeepAlive          = 30 * time.Second
+)
+
+// ConnectionPool configures how connections to the upstream are kept open
+// and reused. Up to MaxIdlePerEndpoint idle connections to each endpoint are
+// kept for IdleTimeout. KeepAlive is the period of TCP keep-alive probes, or
+// of HTTP/2 pings with WithHTTP2, and disables them if negative. If
+// ResponseHeaderTimeout is set, it replaces the WithTimeout limit on waiting
+// for response headers, but not on connecting. Zero values are replaced with
+// defaults.
+type ConnectionPool struct {
+	MaxIdlePerEndpoint    int
+	IdleTimeout           time.Duration
+	KeepAlive             time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+func (p ConnectionPool) withDefaults() ConnectionPool {
+	if p.MaxIdlePerEndpoint <= 0 {
+		p.MaxIdlePerEndpoint = defaultMaxIdlePerEndpoint
+	}
+	if p.IdleTimeout <= 0 {
+		p.IdleTimeout = defaultIdleTimeout
+	}
+	if p.KeepAlive == 0 {
+		p.KeepAlive = defaultKeepAlive
+	}
+
+	return p
+}
+
+// poolMetrics counts the connections the transport dials and reuses. A nil
+// *poolMetrics counts nothing.
+type poolMetrics struct {
+	dialed prometheus.Counter
+	reused prometheus.Counter
+	open   prometheus.Gauge
+}
+
+func newPoolMetrics() *poolMetrics {
+	return &poolMetrics{
+		dialed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "upstream_connection_dial_count",
+			Help: "A counter of new connections dialed to the upstream.",
+		}),
+		reused: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "upstream_connection_reuse_count",
+			Help: "A counter of upstream requests sent on an existing connection.",
+		}),
+		open: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "upstream_open_connections",
+			Help: "A gauge of connections to the upstream currently open.",
+		}),
+	}
+}
+
+func (pm *poolMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{pm.dialed, pm.reused, pm.open}
+}
+
+// track counts a newly dialed connection, and counts it as closed once it
+// is.
+func (pm *poolMetrics) track(conn net.Conn) net.Conn {
+	if pm == nil {
+		return conn
+	}
+
+	pm.dialed.Inc()
+	pm.open.Inc()
+
+	return &trackedNetConn{
+		Conn:   conn,
+		closed: sync.OnceFunc(pm.open.Dec),
+	}
+}
+
+// wrap counts requests that next sends on a connection it already had.
+func (pm *poolMetrics) wrap(next http.RoundTripper) http.RoundTripper {
+	if pm == nil {
+		return next
+	}
+
+	return &reuseTracer{next: next, reused: pm.reused}
+}
+
+type trackedNetConn struct {
+	net.Conn
+	closed func()
+}
+
+func (c *trackedNetConn) Close() error {
+	defer c.closed()
+
+	return c.Conn.Close()
+}
+
+type reuseTracer struct {
+	next   http.RoundTripper
+	reused prometheus.Counter
+}
+
+func (t *reuseTracer) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.reused.Inc()
+			}
+		},
+	}
+
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,254 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RetryOn selects which failed requests are retried.
+type RetryOn string
+
+const (
+	// RetryIdempotent retries requests with idempotent methods, or with an
+	// Idempotency-Key header, after any connection error or a 502, 503, or
+	// 504 response.
+	RetryIdempotent RetryOn = "idempotent"
+	// RetryConnectionErrors retries requests with any method, but only when
+	// the connection was refused or reset.
+	RetryConnectionErrors RetryOn = "connection_errors"
+)
+
+// ParseRetryOn parses a RetryOn. An empty string is RetryIdempotent.
+func ParseRetryOn(s string) (RetryOn, error) {
+	switch RetryOn(s) {
+	case "", RetryIdempotent:
+		return RetryIdempotent, nil
+	case RetryConnectionErrors:
+		return RetryConnectionErrors, nil
+	default:
+		return "", fmt.Errorf("unsupported retry condition %q", s)
+	}
+}
+
+const (
+	defaultRetryAttempts     = 3
+	defaultRetryBackoff      = 25 * time.Millisecond
+	defaultRetryMaxBackoff   = 250 * time.Millisecond
+	defaultRetryMaxBodyBytes = 64 << 10
+)
+
+// RetryPolicy configures Retry. Zero values are replaced with defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a request is sent, including the first.
+	MaxAttempts int
+	// Backoff is the wait before the first retry. It doubles for each
+	// retry after that, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	On         RetryOn
+	// MaxBodyBytes is the largest request body that is buffered so it can
+	// be sent again. Requests with larger bodies are never retried.
+	MaxBodyBytes int64
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryAttempts
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = defaultRetryBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if p.On == "" {
+		p.On = RetryIdempotent
+	}
+	if p.MaxBodyBytes <= 0 {
+		p.MaxBodyBytes = defaultRetryMaxBodyBytes
+	}
+
+	return p
+}
+
+// Retry returns a RoundTripperWrapper that sends failed requests again,
+// according to p. When installed with WithRoundTripperWrappers, each retry
+// goes to another of the upstream's endpoints, if one is healthy, and with
+// metrics, retries are counted in upstream_http_retry_count.
+func Retry(p RetryPolicy) RoundTripperWrapper {
+	p = p.withDefaults()
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &retryTransport{policy: p, next: next}
+	}
+}
+
+type retryTransport struct {
+	policy RetryPolicy
+	next   http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.policy.On == RetryIdempotent && !isIdempotent(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	getBody, err := t.replayableBody(req)
+	if err != nil {
+		return nil, err
+	}
+	if getBody == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	backoff := t.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+
+		attemptReq := req.Clone(ctx)
+		attemptReq.Body = body
+		attemptReq.GetBody = getBody
+
+		resp, err := t.next.RoundTrip(attemptReq)
+
+		reason := t.retryReason(resp, err)
+		if reason == "" || attempt >= t.policy.MaxAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		retriesFromContext(ctx).Inc(reason)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, t.policy.MaxBackoff) //nolint:mnd
+	}
+}
+
+// replayableBody returns a function that returns a fresh copy of the
+// request body for each attempt, or nil if the body can't be replayed. Only
+// bodies with a known length of at most MaxBodyBytes are buffered, so
+// streamed bodies, like gRPC's, reach the upstream as they're sent.
+func (t *retryTransport) replayableBody(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return func() (io.ReadCloser, error) { return http.NoBody, nil }, nil
+	}
+
+	if isGRPC(req) || req.ContentLength <= 0 || req.ContentLength > t.policy.MaxBodyBytes {
+		return nil, nil //nolint:nilnil // nil means the body can't be replayed
+	}
+
+	if req.GetBody != nil {
+		return req.GetBody, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+	if err != nil {
+		return nil, err
+	}
+
+	_ = req.Body.Close()
+
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}, nil
+}
+
+// retryReason returns why the attempt should be retried, or an empty string
+// if it shouldn't.
+func (t *retryTransport) retryReason(resp *http.Response, err error) string {
+	switch {
+	case errors.Is(err, ErrNoHealthyEndpoints), isTimeout(err):
+		// Retrying a timeout would multiply the upstream's timeout.
+		return ""
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case t.policy.On == RetryConnectionErrors:
+		return ""
+	case err != nil:
+		return "error"
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return "status"
+	default:
+		return ""
+	}
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	// Same convention as net/http.Transport.
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+
+	return hasKey || hasXKey
+}
+
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// retryCounter counts retries for the upstream that sent the request. It is
+// passed to RoundTripperWrappers through the request context, since they
+// are created before the upstream's metrics.
+type retryCounter struct {
+	counter *prometheus.CounterVec
+}
+
+func (rc *retryCounter) Inc(reason string) {
+	if rc != nil {
+		rc.counter.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+}
+
+type retryCounterKey struct{}
+
+func withRetryCounter(ctx context.Context, rc *retryCounter) context.Context {
+	if rc == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, retryCounterKey{}, rc)
+}
+
+func retriesFromContext(ctx context.Context) *retryCounter {
+	rc, _ := ctx.Value(retryCounterKey{}).(*retryCounter)
+
+	return rc
+}
@@ -0,0 +1,294 @@
+package upstream_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// failingTransport fails the first failures attempts with err, and records
+// the body of every attempt.
+func failingTransport(failures int, err error) (http.RoundTripper, *[]string) {
+	var bodies []string
+
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) <= failures {
+			return nil, err
+		}
+
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}), &bodies
+}
+
+func newBodyRequest(t *testing.T, method, body string) *http.Request {
+	t.Helper()
+
+	var reqBody io.Reader = http.NoBody
+	if body != "" {
+		reqBody = io.NopCloser(strings.NewReader(body))
+	}
+
+	req, err := http.NewRequestWithContext(
+		context.Background(),
+		method,
+		"http://proxy.example.org/some/path",
+		reqBody,
+	)
+	require.NoError(t, err)
+	req.ContentLength = int64(len(body))
+
+	return req
+}
+
+func TestRetry_ReplaysBody(t *testing.T) {
+	next, bodies := failingTransport(2, fmt.Errorf("dial: %w", syscall.ECONNREFUSED))
+	rt := upstream.Retry(upstream.RetryPolicy{
+		Backoff: time.Millisecond,
+		On:      upstream.RetryConnectionErrors,
+	})(next)
+
+	resp, err := rt.RoundTrip(newBodyRequest(t, http.MethodPost, "hello"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"hello", "hello", "hello"}, *bodies)
+}
+
+func TestRetry_MaxAttempts(t *testing.T) {
+	next, bodies := failingTransport(5, fmt.Errorf("read: %w", syscall.ECONNRESET))
+	rt := upstream.Retry(upstream.RetryPolicy{
+		MaxAttempts: 2,
+		Backoff:     time.Millisecond,
+	})(next)
+
+	_, err := rt.RoundTrip(newBodyRequest(t, http.MethodGet, ""))
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Len(t, *bodies, 2)
+}
+
+func TestRetry_NotIdempotent(t *testing.T) {
+	next, bodies := failingTransport(1, fmt.Errorf("dial: %w", syscall.ECONNREFUSED))
+	rt := upstream.Retry(upstream.RetryPolicy{
+		Backoff: time.Millisecond,
+	})(next)
+
+	_, err := rt.RoundTrip(newBodyRequest(t, http.MethodPost, "hello"))
+	require.Error(t, err)
+	assert.Len(t, *bodies, 1)
+
+	next, bodies = failingTransport(1, fmt.Errorf("dial: %w", syscall.ECONNREFUSED))
+	rt = upstream.Retry(upstream.RetryPolicy{
+		Backoff: time.Millisecond,
+	})(next)
+
+	req := newBodyRequest(t, http.MethodPost, "hello")
+	req.Header.Set("Idempotency-Key", "abc123")
+	_, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Len(t, *bodies, 2)
+}
+
+func TestRetry_ConnectionErrorsOnly(t *testing.T) {
+	next, bodies := failingTransport(1, io.ErrUnexpectedEOF)
+	rt := upstream.Retry(upstream.RetryPolicy{
+		Backoff: time.Millisecond,
+		On:      upstream.RetryConnectionErrors,
+	})(next)
+
+	_, err := rt.RoundTrip(newBodyRequest(t, http.MethodGet, ""))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Len(t, *bodies, 1)
+}
+
+func TestRetry_LargeBody(t *testing.T) {
+	next, bodies := failingTransport(1, fmt.Errorf("dial: %w", syscall.ECONNREFUSED))
+	rt := upstream.Retry(upstream.RetryPolicy{
+		Backoff:      time.Millisecond,
+		On:           upstream.RetryConnectionErrors,
+		MaxBodyBytes: 4,
+	})(next)
+
+	_, err := rt.RoundTrip(newBodyRequest(t, http.MethodPut, "too long to buffer"))
+	require.Error(t, err)
+	assert.Equal(t, []string{"too long to buffer"}, *bodies)
+}
+
+func TestRetry_StreamedBody(t *testing.T) {
+	tests := map[string]func(*http.Request){
+		"unknown length": func(r *http.Request) {
+			r.ContentLength = -1
+		},
+		"grpc": func(r *http.Request) {
+			r.ContentLength = 5
+			r.Header.Set("Content-Type", "application/grpc")
+		},
+	}
+
+	for name, setup := range tests {
+		t.Run(name, func(t *testing.T) {
+			attempts := 0
+			next := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				attempts++
+
+				// The first message arrives before the client sends the rest.
+				buf := make([]byte, 5)
+				_, err := io.ReadFull(r.Body, buf)
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(buf))
+
+				return nil, fmt.Errorf("read: %w", syscall.ECONNRESET)
+			})
+			rt := upstream.Retry(upstream.RetryPolicy{
+				Backoff: time.Millisecond,
+				On:      upstream.RetryConnectionErrors,
+			})(next)
+
+			pr, pw := io.Pipe()
+			defer pw.Close()
+			go func() {
+				_, _ = io.WriteString(pw, "hello")
+			}()
+
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "http://proxy.example.org/svc/Call", pr)
+			require.NoError(t, err)
+			setup(req)
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := rt.RoundTrip(req)
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				require.ErrorIs(t, err, syscall.ECONNRESET)
+			case <-time.After(2 * time.Second):
+				t.Fatal("streamed body did not reach the upstream")
+			}
+			assert.Equal(t, 1, attempts)
+		})
+	}
+}
+
+func TestRetry_Timeout(t *testing.T) {
+	for _, err := range []error{context.DeadlineExceeded, timeoutError{}} {
+		next, bodies := failingTransport(1, err)
+		rt := upstream.Retry(upstream.RetryPolicy{
+			Backoff: time.Millisecond,
+		})(next)
+
+		_, got := rt.RoundTrip(newBodyRequest(t, http.MethodGet, ""))
+		require.ErrorIs(t, got, err)
+		assert.Len(t, *bodies, 1)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout awaiting response headers" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetry_Metrics(t *testing.T) {
+	calls := 0
+	backend := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		_, _ = io.WriteString(w, "a")
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithRoundTripperWrappers(upstream.Retry(upstream.RetryPolicy{Backoff: time.Millisecond})),
+		upstream.WithMetrics(reg),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "a", proxyTo(t, up))
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP upstream_http_retry_count A counter of upstream requests that were sent again after failing.
+# TYPE upstream_http_retry_count counter
+upstream_http_retry_count{reason="status"} 2
+# HELP upstream_http_request_count A counter of upstream requests from the proxy.
+# TYPE upstream_http_request_count counter
+upstream_http_request_count{code="200",method="get"} 1
+`), "upstream_http_retry_count", "upstream_http_request_count")
+	require.NoError(t, err)
+}
+
+func TestRetry_OtherEndpoint(t *testing.T) {
+	for _, balancer := range []upstream.Balancer{upstream.RoundRobin, upstream.LeastRequest} {
+		t.Run(string(balancer), func(t *testing.T) {
+			down := newNamedBackend(t, "down", nil)
+			downAddr := down.Listener.Addr()
+			down.Close()
+			up := newNamedBackend(t, "up", nil)
+
+			reg := prometheus.NewPedanticRegistry()
+			u, err := upstream.New(
+				upstream.WithAddrs(downAddr, up.Listener.Addr()),
+				upstream.WithBalancer(balancer),
+				upstream.WithRoundTripperWrappers(upstream.Retry(upstream.RetryPolicy{
+					MaxAttempts: 2,
+					Backoff:     time.Millisecond,
+					On:          upstream.RetryConnectionErrors,
+				})),
+				upstream.WithMetrics(reg),
+			)
+			require.NoError(t, err)
+
+			// Whichever endpoint each request tries first, its retry goes
+			// to the other one.
+			for range 4 {
+				assert.Equal(t, "up", proxyTo(t, u))
+			}
+
+			retries, err := testutil.GatherAndCount(reg, "upstream_http_retry_count")
+			require.NoError(t, err)
+			assert.Equal(t, 1, retries)
+		})
+	}
+}
+
+func TestParseRetryOn(t *testing.T) {
+	on, err := upstream.ParseRetryOn("")
+	require.NoError(t, err)
+	assert.Equal(t, upstream.RetryIdempotent, on)
+
+	on, err = upstream.ParseRetryOn("connection_errors")
+	require.NoError(t, err)
+	assert.Equal(t, upstream.RetryConnectionErrors, on)
+
+	_, err = upstream.ParseRetryOn("always")
+	require.Error(t, err)
+}
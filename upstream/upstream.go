@@ -2,15 +2,20 @@ package upstream
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"jsocol.io/spiffe-authz-proxy/spiffeidutil"
+	"jsocol.io/spiffe-authz-proxy/traceutil"
 )
 
 type RoundTripperWrapper func(http.RoundTripper) http.RoundTripper
@@ -19,41 +24,176 @@ type httpDoer interface {
 	Do(*http.Request) (*http.Response, error)
 }
 
+// ErrNoHealthyEndpoints is returned by Proxy when every endpoint of the
+// upstream has failed its health checks.
+var ErrNoHealthyEndpoints = errors.New("no healthy upstream endpoints")
+
 type Upstream struct {
-	addr   net.Addr
-	client httpDoer
+	name      string
+	endpoints []*endpoint
+	balancer  Balancer
+	next      atomic.Uint64
+	scheme    string
+	client    httpDoer
+	// transport is used directly by health checks, bypassing any wrappers
+	// and metrics.
+	transport          http.RoundTripper
+	healthCheck        *HealthCheck
+	passiveHealthCheck *PassiveHealthCheck
+	retries            *retryCounter
+	logger             *slog.Logger
 }
 
 func New(opts ...Option) (_ *Upstream, err error) {
-	c := &config{}
+	c := &config{
+		logger: slog.Default(),
+	}
 	for _, opt := range opts {
 		opt.Apply(c)
 	}
 
+	if len(c.addrs) == 0 {
+		return nil, errors.New("an upstream address is required")
+	}
+
+	balancer, err := ParseBalancer(string(c.balancer))
+	if err != nil {
+		return nil, err
+	}
+
+	eps, err := newEndpoints(c.addrs)
+	if err != nil {
+		return nil, err
+	}
+
 	u := &Upstream{
-		addr: c.addr,
+		name:      c.name,
+		endpoints: eps,
+		balancer:  balancer,
+		scheme:    "http",
+		logger:    c.logger,
 	}
 
-	if u.addr == nil {
-		return nil, errors.New("an upstream address is required")
+	if c.healthCheck != nil {
+		u.healthCheck = c.healthCheck.withDefaults()
+	}
+
+	if c.passiveHealthCheck != nil {
+		u.passiveHealthCheck = c.passiveHealthCheck.withDefaults()
+	}
+
+	endpoints := make(map[string]*endpoint, len(u.endpoints))
+	for _, ep := range u.endpoints {
+		endpoints[ep.key] = ep
+	}
+
+	var pm *poolMetrics
+	if c.metrics != nil {
+		pm = newPoolMetrics()
+	}
+
+	pool := c.pool.withDefaults()
+	responseHeaderTimeout := c.timeout
+	if pool.ResponseHeaderTimeout > 0 {
+		responseHeaderTimeout = pool.ResponseHeaderTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   c.timeout,
+		KeepAlive: pool.KeepAlive,
+	}
+	transport := &http.Transport{
+		MaxIdleConnsPerHost:   pool.MaxIdlePerEndpoint,
+		IdleConnTimeout:       pool.IdleTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+
+	dial := func(ctx context.Context, addr string) (net.Conn, *endpoint, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ep, ok := endpoints[host]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown upstream endpoint %s", host)
+		}
+
+		conn, err := dialer.DialContext(ctx, ep.addr.Network(), ep.addr.String())
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not dial upstream %s: %w", ep.addr.String(), err)
+		}
+
+		return pm.track(conn), ep, nil
 	}
 
-	dialer := &net.Dialer{}
-	var t http.RoundTripper = &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			conn, err := dialer.DialContext(ctx, u.addr.Network(), u.addr.String())
+	transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		conn, _, err := dial(ctx, addr)
+
+		return conn, err
+	}
+
+	if c.tlsConfig != nil {
+		u.scheme = "https"
+		transport.TLSClientConfig = c.tlsConfig
+
+		// The transport would send the endpoint's key as the server name,
+		// so the handshake is started here, with the endpoint's real name.
+		// The transport finishes the handshake and negotiates HTTP/2.
+		transport.DialTLSContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, ep, err := dial(ctx, addr)
 			if err != nil {
-				return nil, fmt.Errorf("could not dial upstream %s: %v", u.addr.String(), err)
+				return nil, err
 			}
 
-			return conn, nil
-		},
+			// TLSClientConfig is read here, and not captured above,
+			// because the transport adds its ALPN protocols to it.
+			cfg := transport.TLSClientConfig.Clone()
+			switch {
+			case ep.serverName != "":
+				cfg.ServerName = ep.serverName
+			case cfg.ServerName == "":
+				cfg.ServerName = hostname(ep.host)
+			}
+
+			return tls.Client(conn, cfg), nil
+		}
 	}
 
+	if c.http2 {
+		// Over TLS, HTTP/2 is negotiated with ALPN. Without it, the upstream
+		// must accept HTTP/2 with prior knowledge (h2c), and can't be sent
+		// HTTP/1 upgrades like WebSockets.
+		protocols := new(http.Protocols)
+		if c.tlsConfig != nil {
+			protocols.SetHTTP1(true)
+			protocols.SetHTTP2(true)
+		} else {
+			protocols.SetUnencryptedHTTP2(true)
+		}
+		transport.Protocols = protocols
+
+		if pool.KeepAlive > 0 {
+			transport.HTTP2 = &http.HTTP2Config{
+				SendPingTimeout: pool.KeepAlive,
+			}
+		}
+	}
+
+	u.transport = transport
+
+	var t http.RoundTripper = &balancedTransport{upstream: u, next: pm.wrap(transport)}
+
 	for _, wrap := range c.wrappers {
 		t = wrap(t)
 	}
 
+	var cb *breaker
+	if c.circuitBreaker != nil {
+		cb = newBreaker(*c.circuitBreaker, t)
+		t = cb
+	}
+
 	if c.metrics != nil {
 		reqCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "upstream_http_request_count",
@@ -70,12 +210,46 @@ func New(opts ...Option) (_ *Upstream, err error) {
 			Help: "A gauge of the number of upstream HTTP requests currently in flight.",
 		})
 
-		c.metrics.MustRegister(reqCounter, reqDuration, reqInFlight)
+		reg := c.metrics
+		if u.name != "" {
+			reg = prometheus.WrapRegistererWith(prometheus.Labels{"upstream": u.name}, reg)
+		}
+
+		retries := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "upstream_http_retry_count",
+			Help: "A counter of upstream requests that were sent again after failing.",
+		}, []string{"reason"})
+
+		reg.MustRegister(reqCounter, reqDuration, reqInFlight, retries)
+		u.retries = &retryCounter{counter: retries}
+
+		reg.MustRegister(pm.collectors()...)
+
+		if cb != nil {
+			reg.MustRegister(cb.collectors()...)
+		}
 
+		for _, ep := range u.endpoints {
+			reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "upstream_endpoint_healthy",
+				Help:        "Whether an upstream endpoint is receiving requests, 1 if it is or 0 if it has been ejected.",
+				ConstLabels: prometheus.Labels{"endpoint": ep.addr.String()},
+			}, func() float64 {
+				if ep.available(time.Now()) {
+					return 1
+				}
+
+				return 0
+			}))
+		}
+
+		exemplar := promhttp.WithExemplarFromContext(traceutil.Exemplar)
 		t = promhttp.InstrumentRoundTripperCounter(reqCounter,
 			promhttp.InstrumentRoundTripperDuration(reqDuration,
 				promhttp.InstrumentRoundTripperInFlight(reqInFlight, t),
+				exemplar,
 			),
+			exemplar,
 		)
 	}
 
@@ -87,20 +261,169 @@ func New(opts ...Option) (_ *Upstream, err error) {
 }
 
 func (u *Upstream) Proxy(r *http.Request) (*http.Response, error) {
+	if !u.available(time.Now()) {
+		return nil, ErrNoHealthyEndpoints
+	}
+
+	// The request is canceled once the response body is closed, not when
+	// Proxy returns, so that the body can be streamed.
 	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
+	ctx = withRetryCounter(ctx, u.retries)
+	ctx = withLastEndpoint(ctx)
 	req := r.WithContext(ctx)
 
-	spid := spiffeidutil.FromContext(ctx)
-	if !spid.IsZero() {
-		req.Header.Set("SPIFFE-ID", spid.String())
+	// The handler doesn't know how the upstream is reached, so the scheme
+	// decides whether the transport does a TLS handshake. The endpoint is
+	// picked by balancedTransport, for each attempt if the request is
+	// retried. The Host header is left alone.
+	reqURL := *req.URL
+	reqURL.Scheme = u.scheme
+	req.URL = &reqURL
+	if req.Host == "" {
+		req.Host = r.URL.Host
+	}
+
+	resp, err := u.client.Do(req)
+	if open, ok := isCircuitOpen(err); ok {
+		cancel()
+
+		return open.response(r), nil
+	}
+
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	// For an upgraded connection, the body stays writable, so it can be
+	// spliced to the caller.
+	resp.Body = newTrackedBody(resp.Body, sync.OnceFunc(cancel))
+
+	return resp, nil
+}
+
+// balancedTransport sends each attempt of a request to the endpoint picked
+// by the upstream's Balancer, so that retries can go to another endpoint.
+type balancedTransport struct {
+	upstream *Upstream
+	next     http.RoundTripper
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	last := lastEndpointFromContext(ctx)
+
+	ep := t.upstream.pick(time.Now(), last.Load())
+	if ep == nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+
+		return nil, ErrNoHealthyEndpoints
+	}
+	last.Store(ep)
+
+	// The host decides which endpoint the transport dials.
+	attempt := req.WithContext(ctx)
+	attemptURL := *req.URL
+	attemptURL.Host = ep.key
+	attempt.URL = &attemptURL
+
+	ep.inflight.Add(1)
+	resp, err := t.next.RoundTrip(attempt)
+	t.upstream.observe(ctx, ep, resp, err)
+	if err != nil {
+		ep.inflight.Add(-1)
+
+		return nil, err
+	}
+
+	resp.Body = newTrackedBody(resp.Body, sync.OnceFunc(func() {
+		ep.inflight.Add(-1)
+	}))
+
+	return resp, nil
+}
+
+// available reports whether any endpoint can receive requests.
+func (u *Upstream) available(now time.Time) bool {
+	for _, ep := range u.endpoints {
+		if ep.available(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pick returns the endpoint for the next request, or nil if none are healthy.
+// It avoids the endpoint that the last attempt of a retried request went to,
+// unless it's the only one left.
+func (u *Upstream) pick(now time.Time, avoid *endpoint) *endpoint {
+	n := uint64(len(u.endpoints))
+	start := u.next.Add(1) - 1
+
+	var best, fallback *endpoint
+	for i := range n {
+		ep := u.endpoints[(start+i)%n]
+		if !ep.available(now) {
+			continue
+		}
+
+		if ep == avoid {
+			fallback = ep
+
+			continue
+		}
+
+		if u.balancer == RoundRobin {
+			return ep
+		}
+
+		if best == nil || ep.inflight.Load() < best.inflight.Load() {
+			best = ep
+		}
+	}
+
+	if best == nil {
+		return fallback
+	}
+
+	return best
+}
+
+type lastEndpointKey struct{}
+
+// withLastEndpoint adds a place to record which endpoint each attempt of a
+// request went to, so that a retry can avoid it.
+func withLastEndpoint(ctx context.Context) context.Context {
+	return context.WithValue(ctx, lastEndpointKey{}, new(atomic.Pointer[endpoint]))
+}
+
+func lastEndpointFromContext(ctx context.Context) *atomic.Pointer[endpoint] {
+	if last, ok := ctx.Value(lastEndpointKey{}).(*atomic.Pointer[endpoint]); ok {
+		return last
 	}
 
-	return u.client.Do(req)
+	return new(atomic.Pointer[endpoint])
+}
+
+// CloseIdleConnections closes the connections to the upstream that aren't
+// carrying a request, like when the proxy shuts down.
+func (u *Upstream) CloseIdleConnections() {
+	if t, ok := u.transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
 }
 
+// Addr returns the address of the upstream's first endpoint.
 func (u *Upstream) Addr() net.Addr {
-	return u.addr
+	return u.endpoints[0].addr
+}
+
+func (u *Upstream) Name() string {
+	return u.name
 }
 
 type Option interface {
@@ -108,9 +431,19 @@ type Option interface {
 }
 
 type config struct {
-	addr     net.Addr
-	wrappers []RoundTripperWrapper
-	metrics  prometheus.Registerer
+	name               string
+	addrs              []endpointAddr
+	balancer           Balancer
+	healthCheck        *HealthCheck
+	passiveHealthCheck *PassiveHealthCheck
+	circuitBreaker     *CircuitBreaker
+	timeout            time.Duration
+	pool               ConnectionPool
+	http2              bool
+	wrappers           []RoundTripperWrapper
+	metrics            prometheus.Registerer
+	tlsConfig          *tls.Config
+	logger             *slog.Logger
 }
 
 type optionFunc func(*config)
@@ -119,9 +452,104 @@ func (o optionFunc) Apply(c *config) {
 	o(c)
 }
 
+// WithAddr adds an endpoint to the upstream. It is the same as WithAddrs
+// with a single address.
 func WithAddr(a net.Addr) Option {
+	return WithAddrs(a)
+}
+
+// WithAddrs adds endpoints to the upstream. Requests are spread across them
+// by the upstream's Balancer.
+func WithAddrs(addrs ...net.Addr) Option {
 	return optionFunc(func(c *config) {
-		c.addr = a
+		for _, addr := range addrs {
+			c.addrs = append(c.addrs, endpointAddr{addr: addr})
+		}
+	})
+}
+
+// WithEndpoint adds an endpoint at addr, which was configured as host, like
+// "api.internal:8443". Health checks send host as their Host header, and with
+// WithTLSConfig, its name is sent and verified during the TLS handshake.
+// Proxied requests keep their own Host header.
+func WithEndpoint(addr net.Addr, host string) Option {
+	return optionFunc(func(c *config) {
+		c.addrs = append(c.addrs, endpointAddr{addr: addr, host: host})
+	})
+}
+
+// WithBalancer sets how requests are spread across endpoints. The default
+// is RoundRobin.
+func WithBalancer(b Balancer) Option {
+	return optionFunc(func(c *config) {
+		c.balancer = b
+	})
+}
+
+// WithHealthCheck enables active health checks, which run while Run is
+// running.
+func WithHealthCheck(hc HealthCheck) Option {
+	return optionFunc(func(c *config) {
+		c.healthCheck = &hc
+	})
+}
+
+// WithPassiveHealthCheck ejects endpoints whose proxied requests keep
+// failing.
+func WithPassiveHealthCheck(phc PassiveHealthCheck) Option {
+	return optionFunc(func(c *config) {
+		c.passiveHealthCheck = &phc
+	})
+}
+
+// WithCircuitBreaker stops sending requests to the upstream while it is
+// failing or slow, answering them with a 503 instead.
+func WithCircuitBreaker(cb CircuitBreaker) Option {
+	return optionFunc(func(c *config) {
+		c.circuitBreaker = &cb
+	})
+}
+
+// WithTimeout limits how long each request waits to connect to the
+// upstream, and then for the response headers. It doesn't limit how long
+// the response body takes, so that responses can be streamed.
+func WithTimeout(d time.Duration) Option {
+	return optionFunc(func(c *config) {
+		c.timeout = d
+	})
+}
+
+// WithConnectionPool changes how connections to the upstream are kept open
+// and reused. By default, up to 32 idle connections to each endpoint are kept
+// for 90s.
+func WithConnectionPool(p ConnectionPool) Option {
+	return optionFunc(func(c *config) {
+		c.pool = p
+	})
+}
+
+// WithHTTP2 speaks HTTP/2 to the upstream, as gRPC requires. With
+// WithTLSConfig, HTTP/2 is offered during the TLS handshake, and HTTP/1.1 is
+// used if the upstream doesn't accept it. Otherwise, every request uses
+// cleartext HTTP/2 (h2c) with prior knowledge.
+func WithHTTP2() Option {
+	return optionFunc(func(c *config) {
+		c.http2 = true
+	})
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return optionFunc(func(c *config) {
+		c.logger = l
+	})
+}
+
+// WithName distinguishes this upstream from others the proxy routes to. The
+// name is added to the upstream's metrics as the "upstream" label, so every
+// upstream sharing a registry must have one.
+func WithName(name string) Option {
+	return optionFunc(func(c *config) {
+		c.name = name
 	})
 }
 
@@ -131,6 +559,13 @@ func WithRoundTripperWrappers(wrappers ...RoundTripperWrapper) Option {
 	})
 }
 
+// WithTLSConfig connects to the upstream with TLS, using t.
+func WithTLSConfig(t *tls.Config) Option {
+	return optionFunc(func(c *config) {
+		c.tlsConfig = t
+	})
+}
+
 func WithMetrics(r prometheus.Registerer) Option {
 	return optionFunc(func(c *config) {
 		c.metrics = r
@@ -0,0 +1,784 @@
+package upstream_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spiffe/go-spiffe/v2/bundle/x509bundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"jsocol.io/spiffe-authz-proxy/tlsutil"
+	"jsocol.io/spiffe-authz-proxy/upstream"
+)
+
+func TestUpstream_Proxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	up, err := upstream.New(upstream.WithAddr(backend.Listener.Addr()))
+	require.NoError(t, err)
+
+	assertProxies(t, up)
+}
+
+func TestUpstream_TLS_WebPKI(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(backend.Certificate())
+
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	bundle, svids := newTestSVIDs(t, td, spiffeid.RequireFromString("spiffe://example.org/proxy"))
+
+	t.Run("trusted", func(t *testing.T) {
+		up, err := upstream.New(
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithTLSConfig(tlsutil.UpstreamClientConfig(svids[0], bundle, nil, roots, "example.com")),
+		)
+		require.NoError(t, err)
+
+		assertProxies(t, up)
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		up, err := upstream.New(
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithTLSConfig(
+				tlsutil.UpstreamClientConfig(svids[0], bundle, nil, x509.NewCertPool(), "example.com"),
+			),
+		)
+		require.NoError(t, err)
+
+		_, err = up.Proxy(newRequest(t))
+		require.Error(t, err)
+	})
+}
+
+func TestUpstream_TLS_SPIFFE(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	proxyID := spiffeid.RequireFromString("spiffe://example.org/proxy")
+	appID := spiffeid.RequireFromString("spiffe://example.org/app")
+	bundle, svids := newTestSVIDs(t, td, proxyID, appID)
+
+	var clientID spiffeid.ID
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, _ = x509svid.IDFromCert(r.TLS.PeerCertificates[0])
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	backend.TLS = tlsconfig.MTLSServerConfig(svids[1], bundle, tlsconfig.AuthorizeAny())
+	backend.StartTLS()
+	defer backend.Close()
+
+	t.Run("expected id", func(t *testing.T) {
+		up, err := upstream.New(
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithTLSConfig(
+				tlsutil.UpstreamClientConfig(svids[0], bundle, tlsconfig.AuthorizeID(appID), nil, "app.example.org"),
+			),
+		)
+		require.NoError(t, err)
+
+		assertProxies(t, up)
+		assert.Equal(t, proxyID, clientID, "the proxy presents its own SVID")
+	})
+
+	t.Run("unexpected id", func(t *testing.T) {
+		up, err := upstream.New(
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithTLSConfig(
+				tlsutil.UpstreamClientConfig(svids[0], bundle, tlsconfig.AuthorizeID(proxyID), nil, "app.example.org"),
+			),
+		)
+		require.NoError(t, err)
+
+		_, err = up.Proxy(newRequest(t))
+		require.Error(t, err)
+	})
+}
+
+func newRequest(t *testing.T) *http.Request {
+	t.Helper()
+
+	// The proxy handler always builds http:// URLs with the inbound host.
+	req, err := http.NewRequestWithContext(
+		context.Background(),
+		http.MethodGet,
+		"http://proxy.example.org/some/path",
+		http.NoBody,
+	)
+	require.NoError(t, err)
+
+	return req
+}
+
+func assertProxies(t *testing.T, up *upstream.Upstream) {
+	t.Helper()
+
+	resp, err := up.Proxy(newRequest(t))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /some/path", strings.TrimSpace(string(body)))
+}
+
+// newTestSVIDs creates a CA for td and an X509-SVID signed by it for each id.
+func newTestSVIDs(t *testing.T, td spiffeid.TrustDomain, ids ...spiffeid.ID) (*x509bundle.Bundle, []*x509svid.SVID) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		URIs:                  []*url.URL{td.ID().URL()},
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	svids := make([]*x509svid.SVID, 0, len(ids))
+	for i, id := range ids {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i) + 2),
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			URIs:         []*url.URL{id.URL()},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+
+		svids = append(svids, &x509svid.SVID{
+			ID:           id,
+			Certificates: []*x509.Certificate{leaf},
+			PrivateKey:   key,
+		})
+	}
+
+	return x509bundle.FromX509Authorities(td, []*x509.Certificate{ca}), svids
+}
+
+func TestUpstream_Name(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+
+	for _, name := range []string{"api", "admin"} {
+		up, err := upstream.New(
+			upstream.WithName(name),
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithMetrics(reg),
+		)
+		require.NoError(t, err)
+		assert.Equal(t, name, up.Name())
+
+		assertProxies(t, up)
+	}
+
+	err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP upstream_http_request_count A counter of upstream requests from the proxy.
+# TYPE upstream_http_request_count counter
+upstream_http_request_count{code="200",method="get",upstream="admin"} 1
+upstream_http_request_count{code="200",method="get",upstream="api"} 1
+`), "upstream_http_request_count")
+	require.NoError(t, err)
+}
+
+func newNamedBackend(t *testing.T, name string, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil {
+			handler(w, r)
+
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil {
+			handler(w, r)
+
+			return
+		}
+		_, _ = io.WriteString(w, name)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func proxyTo(t *testing.T, up *upstream.Upstream) string {
+	t.Helper()
+
+	resp, err := up.Proxy(newRequest(t))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return string(body)
+}
+
+func TestUpstream_RoundRobin(t *testing.T) {
+	a := newNamedBackend(t, "a", nil)
+	b := newNamedBackend(t, "b", nil)
+
+	up, err := upstream.New(upstream.WithAddrs(a.Listener.Addr(), b.Listener.Addr()))
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	for range 4 {
+		counts[proxyTo(t, up)]++
+	}
+
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, counts)
+}
+
+func TestUpstream_LeastRequest(t *testing.T) {
+	a := newNamedBackend(t, "a", nil)
+	b := newNamedBackend(t, "b", nil)
+
+	up, err := upstream.New(
+		upstream.WithAddrs(a.Listener.Addr(), b.Listener.Addr()),
+		upstream.WithBalancer(upstream.LeastRequest),
+	)
+	require.NoError(t, err)
+
+	// The first response stays open, so its endpoint has a request in flight.
+	held, err := up.Proxy(newRequest(t))
+	require.NoError(t, err)
+	heldBody, err := io.ReadAll(held.Body)
+	require.NoError(t, err)
+
+	other := "a"
+	if string(heldBody) == "a" {
+		other = "b"
+	}
+
+	for range 3 {
+		assert.Equal(t, other, proxyTo(t, up))
+	}
+
+	require.NoError(t, held.Body.Close())
+}
+
+func TestUpstream_HealthCheck(t *testing.T) {
+	a := newNamedBackend(t, "a", nil)
+	b := newNamedBackend(t, "b", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	reg := prometheus.NewPedanticRegistry()
+	up, err := upstream.New(
+		upstream.WithAddrs(a.Listener.Addr(), b.Listener.Addr()),
+		upstream.WithHealthCheck(upstream.HealthCheck{
+			Path:               "/healthz",
+			Interval:           10 * time.Millisecond,
+			UnhealthyThreshold: 1,
+		}),
+		upstream.WithMetrics(reg),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = up.Run(ctx) }()
+
+	require.Eventually(t, func() bool {
+		return testutil.CollectAndCount(reg, "upstream_endpoint_healthy") == 2 &&
+			gatherGauge(t, reg, "upstream_endpoint_healthy", b.Listener.Addr().String()) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	assert.InDelta(t, 1, gatherGauge(t, reg, "upstream_endpoint_healthy", a.Listener.Addr().String()), 0)
+	for range 4 {
+		assert.Equal(t, "a", proxyTo(t, up))
+	}
+}
+
+func TestUpstream_EndpointHost(t *testing.T) {
+	td := spiffeid.RequireTrustDomainFromString("example.org")
+	appID := spiffeid.RequireFromString("spiffe://example.org/app")
+	bundle, svids := newTestSVIDs(t, td, spiffeid.RequireFromString("spiffe://example.org/proxy"), appID)
+
+	type seen struct{ host, serverName string }
+	checks := make(chan seen, 10)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			select {
+			case checks <- seen{r.Host, r.TLS.ServerName}:
+			default:
+			}
+
+			return
+		}
+		_, _ = io.WriteString(w, r.Host+" "+r.TLS.ServerName)
+	}))
+	backend.TLS = tlsconfig.MTLSServerConfig(svids[1], bundle, tlsconfig.AuthorizeAny())
+	backend.StartTLS()
+	defer backend.Close()
+
+	// No server name is set, like for an upstream with a SPIFFE ID.
+	up, err := upstream.New(
+		upstream.WithEndpoint(backend.Listener.Addr(), "app.internal:8443"),
+		upstream.WithTLSConfig(
+			tlsutil.UpstreamClientConfig(svids[0], bundle, tlsconfig.AuthorizeID(appID), nil, ""),
+		),
+		upstream.WithHealthCheck(upstream.HealthCheck{
+			Path:     "/healthz",
+			Interval: time.Hour,
+		}),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = up.Run(ctx) }()
+
+	select {
+	case check := <-checks:
+		assert.Equal(t, seen{"app.internal:8443", "app.internal"}, check)
+	case <-time.After(time.Second):
+		require.Fail(t, "no health check")
+	}
+
+	resp, err := up.Proxy(newRequest(t))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "proxy.example.org app.internal", string(body), "proxied requests keep their Host")
+}
+
+func TestUpstream_DefaultHost(t *testing.T) {
+	hosts := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case hosts <- r.Host:
+		default:
+		}
+	}))
+	defer backend.Close()
+
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithHealthCheck(upstream.HealthCheck{
+			Path:     "/healthz",
+			Interval: time.Hour,
+		}),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = up.Run(ctx) }()
+
+	select {
+	case host := <-hosts:
+		assert.Equal(t, backend.Listener.Addr().String(), host)
+	case <-time.After(time.Second):
+		require.Fail(t, "no health check")
+	}
+}
+
+func TestUpstream_DuplicateEndpoints(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000}
+
+	_, err := upstream.New(
+		upstream.WithAddr(addr),
+		upstream.WithEndpoint(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000}, "app.internal:8000"),
+	)
+	require.ErrorContains(t, err, "duplicate upstream endpoint")
+}
+
+func TestUpstream_Check(t *testing.T) {
+	t.Run("reachable", func(t *testing.T) {
+		backend := newNamedBackend(t, "a", nil)
+
+		up, err := upstream.New(upstream.WithAddr(backend.Listener.Addr()))
+		require.NoError(t, err)
+
+		require.NoError(t, up.Check(context.Background()))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		backend := newNamedBackend(t, "a", nil)
+		addr := backend.Listener.Addr()
+		backend.Close()
+
+		up, err := upstream.New(upstream.WithAddr(addr))
+		require.NoError(t, err)
+
+		require.ErrorContains(t, up.Check(context.Background()), "could not reach upstream")
+	})
+
+	t.Run("no healthy endpoints", func(t *testing.T) {
+		backend := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		up, err := upstream.New(
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithHealthCheck(upstream.HealthCheck{
+				Path:               "/healthz",
+				Interval:           10 * time.Millisecond,
+				UnhealthyThreshold: 1,
+			}),
+		)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() { _ = up.Run(ctx) }()
+
+		require.Eventually(t, func() bool {
+			return errors.Is(up.Check(ctx), upstream.ErrNoHealthyEndpoints)
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestUpstream_PassiveHealthCheck(t *testing.T) {
+	a := newNamedBackend(t, "a", nil)
+	b := newNamedBackend(t, "b", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	up, err := upstream.New(
+		upstream.WithAddrs(a.Listener.Addr(), b.Listener.Addr()),
+		upstream.WithPassiveHealthCheck(upstream.PassiveHealthCheck{
+			ConsecutiveFailures: 1,
+			EjectionTime:        time.Hour,
+		}),
+	)
+	require.NoError(t, err)
+
+	// One request reaches b and fails, which ejects it.
+	proxyTo(t, up)
+	proxyTo(t, up)
+
+	for range 4 {
+		assert.Equal(t, "a", proxyTo(t, up))
+	}
+}
+
+func TestUpstream_NoHealthyEndpoints(t *testing.T) {
+	a := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	up, err := upstream.New(
+		upstream.WithAddr(a.Listener.Addr()),
+		upstream.WithPassiveHealthCheck(upstream.PassiveHealthCheck{
+			ConsecutiveFailures: 1,
+			EjectionTime:        time.Hour,
+		}),
+	)
+	require.NoError(t, err)
+
+	proxyTo(t, up)
+
+	_, err = up.Proxy(newRequest(t))
+	require.ErrorIs(t, err, upstream.ErrNoHealthyEndpoints)
+}
+
+func TestParseBalancer(t *testing.T) {
+	b, err := upstream.ParseBalancer("")
+	require.NoError(t, err)
+	assert.Equal(t, upstream.RoundRobin, b)
+
+	b, err = upstream.ParseBalancer("least_request")
+	require.NoError(t, err)
+	assert.Equal(t, upstream.LeastRequest, b)
+
+	_, err = upstream.ParseBalancer("random")
+	require.Error(t, err)
+}
+
+func gatherGauge(t *testing.T, reg prometheus.Gatherer, name, endpoint string) float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "endpoint" && l.GetValue() == endpoint {
+					return m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+
+	t.Fatalf("no %s metric for endpoint %s", name, endpoint)
+
+	return 0
+}
+
+func TestUpstream_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	defer close(release)
+
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithTimeout(20*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	_, err = up.Proxy(newRequest(t))
+	require.Error(t, err)
+
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
+
+func TestUpstream_StreamsBody(t *testing.T) {
+	next := make(chan struct{})
+	backend := newNamedBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+
+		<-next
+		_, _ = io.WriteString(w, "second\n")
+	})
+
+	up, err := upstream.New(upstream.WithAddr(backend.Listener.Addr()))
+	require.NoError(t, err)
+
+	resp, err := up.Proxy(newRequest(t))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	buf := make([]byte, len("first\n"))
+	_, err = io.ReadFull(resp.Body, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n", string(buf))
+
+	close(next)
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", string(rest))
+}
+
+func TestUpstream_Upgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		_ = brw.Flush()
+
+		// Echo one line back.
+		line, _ := brw.ReadString('\n')
+		_, _ = io.WriteString(conn, line)
+	}))
+	defer backend.Close()
+
+	up, err := upstream.New(upstream.WithAddr(backend.Listener.Addr()))
+	require.NoError(t, err)
+
+	req := newRequest(t)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	resp, err := up.Proxy(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	require.True(t, ok, "the body of an upgraded response must be writable")
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "hello\n")
+	require.NoError(t, err)
+
+	echo, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(echo))
+}
+
+func TestUpstream_HTTP2(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = io.WriteString(w, r.Proto)
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	t.Run("h2c", func(t *testing.T) {
+		backend := httptest.NewUnstartedServer(handler)
+		backend.Config.Protocols = new(http.Protocols)
+		backend.Config.Protocols.SetUnencryptedHTTP2(true)
+		backend.Start()
+		defer backend.Close()
+
+		up, err := upstream.New(
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithHTTP2(),
+		)
+		require.NoError(t, err)
+
+		resp, err := up.Proxy(newRequest(t))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", string(body))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		backend := httptest.NewUnstartedServer(handler)
+		backend.EnableHTTP2 = true
+		backend.StartTLS()
+		defer backend.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(backend.Certificate())
+
+		td := spiffeid.RequireTrustDomainFromString("example.org")
+		bundle, svids := newTestSVIDs(t, td, spiffeid.RequireFromString("spiffe://example.org/proxy"))
+
+		up, err := upstream.New(
+			upstream.WithAddr(backend.Listener.Addr()),
+			upstream.WithTLSConfig(tlsutil.UpstreamClientConfig(svids[0], bundle, nil, roots, "example.com")),
+			upstream.WithHTTP2(),
+		)
+		require.NoError(t, err)
+
+		resp, err := up.Proxy(newRequest(t))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", string(body))
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	})
+}
+
+func TestUpstream_ConnectionPool(t *testing.T) {
+	backend := newNamedBackend(t, "a", nil)
+
+	reg := prometheus.NewPedanticRegistry()
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithConnectionPool(upstream.ConnectionPool{
+			MaxIdlePerEndpoint: 4,
+			IdleTimeout:        time.Minute,
+		}),
+		upstream.WithMetrics(reg),
+	)
+	require.NoError(t, err)
+
+	for range 3 {
+		assert.Equal(t, "a", proxyTo(t, up))
+	}
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP upstream_connection_dial_count A counter of new connections dialed to the upstream.
+# TYPE upstream_connection_dial_count counter
+upstream_connection_dial_count 1
+# HELP upstream_connection_reuse_count A counter of upstream requests sent on an existing connection.
+# TYPE upstream_connection_reuse_count counter
+upstream_connection_reuse_count 2
+# HELP upstream_open_connections A gauge of connections to the upstream currently open.
+# TYPE upstream_open_connections gauge
+upstream_open_connections 1
+`), "upstream_connection_dial_count", "upstream_connection_reuse_count", "upstream_open_connections")
+	require.NoError(t, err)
+
+	// Idle connections the upstream closes are no longer counted as open.
+	backend.CloseClientConnections()
+	assert.Eventually(t, func() bool {
+		return testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP upstream_open_connections A gauge of connections to the upstream currently open.
+# TYPE upstream_open_connections gauge
+upstream_open_connections 0
+`), "upstream_open_connections") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUpstream_CloseIdleConnections(t *testing.T) {
+	backend := newNamedBackend(t, "a", nil)
+
+	reg := prometheus.NewPedanticRegistry()
+	up, err := upstream.New(
+		upstream.WithAddr(backend.Listener.Addr()),
+		upstream.WithMetrics(reg),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, "a", proxyTo(t, up))
+
+	up.CloseIdleConnections()
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP upstream_open_connections A gauge of connections to the upstream currently open.
+# TYPE upstream_open_connections gauge
+upstream_open_connections 0
+`), "upstream_open_connections")
+	require.NoError(t, err)
+}